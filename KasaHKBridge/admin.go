@@ -0,0 +1,183 @@
+package kasahkbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	// use go-chi since it is what hap uses, no need for multiple
+	"github.com/go-chi/chi"
+)
+
+// AdminServer serves the bridge status, bind it to localhost unless you have a reason not to
+func (b *Bridge) AdminServer(ctx context.Context) {
+	addr := b.conf.AdminAddr
+	if addr == "" {
+		return
+	}
+
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Kasa HomeKit Bridge"))
+	})
+	router.Get("/wifi", b.wifiHandler)
+	router.Get("/wifi/{device}", b.wifiDeviceHandler)
+	router.Get("/firmware", func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, b.Firmware())
+	})
+	router.Get("/lux/{device}", b.luxHandler)
+	router.Get("/events", b.eventsHandler)
+
+	srv := &http.Server{
+		Handler:      router,
+		Addr:         addr,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		// end the event streams on shutdown, Shutdown doesn't
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	slog.Info("starting admin service", "addr", addr)
+	go func() {
+		// a port already in use would otherwise leave the admin API silently missing
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin service failed", "addr", addr, "err", err)
+		}
+	}()
+	<-ctx.Done()
+	slog.Info("stopping admin service")
+	if err := srv.Shutdown(context.Background()); err != nil {
+		slog.Warn("admin server shutdown error", "err", err)
+	}
+}
+
+// wifiHandler lists every device, weakest average signal first
+func (b *Bridge) wifiHandler(w http.ResponseWriter, r *http.Request) {
+	var reports []WifiReport
+
+	b.kasasMu.RLock()
+	for _, k := range b.kasas {
+		reports = append(reports, k.wifiReport(false))
+	}
+	b.kasasMu.RUnlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].AvgRSSI < reports[j].AvgRSSI
+	})
+
+	respondJSON(w, reports)
+}
+
+// wifiDeviceHandler includes the RSSI history, the device can be given by DeviceID or alias
+func (b *Bridge) wifiDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	k := b.findDevice(chi.URLParam(r, "device"))
+	if k == nil {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	respondJSON(w, k.wifiReport(true))
+}
+
+// luxHandler gives the last raw light level from a KS200M, for calibration
+func (b *Bridge) luxHandler(w http.ResponseWriter, r *http.Request) {
+	k := b.findDevice(chi.URLParam(r, "device"))
+	if k == nil {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	ks, ok := k.(*KS200m)
+	if !ok {
+		http.Error(w, "not a KS200M", http.StatusBadRequest)
+		return
+	}
+
+	respondJSON(w, ks.luxReport())
+}
+
+// eventsHandler streams state changes as server-sent events, ?type=relay,emeter and ?device=<DeviceID or alias> narrow it down
+func (b *Bridge) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var types []string
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = strings.Split(t, ",")
+	}
+	device := r.URL.Query().Get("device")
+
+	// the stream outlives the server's WriteTimeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ch := b.events.subscribe()
+	defer b.events.unsubscribe(ch)
+
+	// keep proxies and idle timeouts from closing a quiet stream
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case ev := <-ch:
+			if len(types) > 0 && !slices.Contains(types, ev.Type) {
+				continue
+			}
+			if device != "" && device != ev.DeviceID && device != ev.Alias {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Warn("unable to encode event", "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (b *Bridge) findDevice(name string) kasaDevice {
+	b.kasasMu.RLock()
+	defer b.kasasMu.RUnlock()
+
+	if k, ok := b.kasas[name]; ok {
+		return k
+	}
+	for _, k := range b.kasas {
+		if k.getAlias() == name {
+			return k
+		}
+	}
+	return nil
+}
+
+func respondJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("unable to write response", "err", err)
+	}
+}
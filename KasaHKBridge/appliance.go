@@ -0,0 +1,104 @@
+package kasahkbridge
+
+import (
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+// applianceSvc turns the emeter readings into a running/done sensor, for washers, dryers, dishwashers...
+type applianceSvc struct {
+	*service.S
+
+	Occupancy *characteristic.OccupancyDetected  // set for "occupancy"
+	Contact   *characteristic.ContactSensorState // set for "contact", open while running
+	Name      *characteristic.Name
+
+	conf    ApplianceConfig
+	running bool
+	since   time.Time // when the readings started crossing toward the other state, zero if they are not
+}
+
+func newApplianceSvc(ac ApplianceConfig) *applianceSvc {
+	svc := applianceSvc{conf: ac}
+
+	switch ac.Sensor {
+	case "contact":
+		s := service.NewContactSensor()
+		svc.S = s.S
+		svc.Contact = s.ContactSensorState
+		svc.Contact.SetValue(characteristic.ContactSensorStateContactDetected)
+	default:
+		s := service.NewOccupancySensor()
+		svc.S = s.S
+		svc.Occupancy = s.OccupancyDetected
+		svc.Occupancy.SetValue(characteristic.OccupancyDetectedOccupancyNotDetected)
+	}
+
+	name := ac.Name
+	if name == "" {
+		name = "Running"
+	}
+	svc.Name = characteristic.NewName()
+	svc.Name.SetValue(name)
+	svc.AddC(svc.Name.C)
+
+	return &svc
+}
+
+// sample feeds one emeter reading in, it returns true if the running state changed
+func (a *applianceSvc) sample(e kasa.EmeterRealtime, now time.Time) bool {
+	watts := float64(e.PowerMW) / 1000
+
+	crossing := watts > a.conf.OnWatts
+	hold := time.Duration(a.conf.OnSeconds) * time.Second
+	if a.running {
+		crossing = watts < a.conf.OffWatts
+		hold = time.Duration(a.conf.OffSeconds) * time.Second
+	}
+
+	if !crossing {
+		a.since = time.Time{}
+		return false
+	}
+	if a.since.IsZero() {
+		a.since = now
+	}
+	if now.Sub(a.since) < hold {
+		return false
+	}
+
+	a.running = !a.running
+	a.since = time.Time{}
+
+	if a.Contact != nil {
+		state := characteristic.ContactSensorStateContactDetected
+		if a.running {
+			state = characteristic.ContactSensorStateContactNotDetected
+		}
+		a.Contact.SetValue(state)
+	} else {
+		state := characteristic.OccupancyDetectedOccupancyNotDetected
+		if a.running {
+			state = characteristic.OccupancyDetectedOccupancyDetected
+		}
+		a.Occupancy.SetValue(state)
+	}
+	return true
+}
+
+// addAppliance adds the optional appliance sensor, g.A must exist first, called after addLED so other service IDs don't move
+func (g *generic) addAppliance() *applianceSvc {
+	dc, ok := g.b.conf.device(g.Sysinfo.DeviceID, g.Sysinfo.Alias)
+	if !ok || dc.Appliance == nil {
+		return nil
+	}
+
+	a := newApplianceSvc(*dc.Appliance)
+	g.A.AddS(a.S)
+	g.logger().Info("appliance sensor", "on_watts", a.conf.OnWatts, "on_seconds", a.conf.OnSeconds, "off_watts", a.conf.OffWatts, "off_seconds", a.conf.OffSeconds)
+	return a
+}
@@ -1,19 +1,75 @@
 package kasahkbridge
 
 import (
-	// "time"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	// "github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 )
 
-var root *accessory.Bridge
+// Bridge owns everything for one set of Kasa devices, more than one can run in a process.
+//
+// Devices are only changed on the Listener goroutine: update, the incoming*Data methods, outageRecovered and afterOutage
+// all run there. HomeKit, MQTT, the poller and the admin API each have their own goroutines and stick to the kasaDevice
+// methods that read through the device lock, setRelay and setBrightness send to the device and leave the Listener to
+// pick up the result. kasas, relays and ifaces each have their own lock.
+type Bridge struct {
+	conf *Config
+	root *accessory.Bridge
 
-// Bridge is used by the startup to build the generic bridge type on which all other devices hang
-func Bridge() *accessory.A {
-	root = accessory.NewBridge(accessory.Info{
+	kasas   map[string]kasaDevice
+	kasasMu sync.RWMutex
+	groups  []*group
+
+	// last relay states commanded from HomeKit, for after_outage
+	relays    map[string]map[string]bool
+	relaysMu  sync.Mutex
+	relayPath string
+
+	// replies to direct requests arrive on packetconn, replies to discovery on the per-interface sockets
+	packetconn   *net.UDPConn
+	ifaces       map[string]*ifaceConn // keyed by the local address
+	ifacesMu     sync.Mutex
+	packets      chan packet
+	ready        chan struct{} // closed once packetconn is open
+	listenerDone chan struct{}
+
+	pollInterval time.Duration
+	events       eventBus
+}
+
+// NewBridge sets up a bridge using the config, nil uses the defaults
+func NewBridge(c *Config) *Bridge {
+	if c == nil {
+		c = &Config{}
+	}
+
+	b := Bridge{
+		conf:         c,
+		kasas:        make(map[string]kasaDevice),
+		relays:       make(map[string]map[string]bool),
+		ifaces:       make(map[string]*ifaceConn),
+		packets:      make(chan packet, 64),
+		ready:        make(chan struct{}),
+		listenerDone: make(chan struct{}),
+		pollInterval: 30 * time.Second,
+	}
+	b.root = b.newRoot()
+	b.groups = newGroups(&b)
+
+	return &b
+}
+
+// Root is the generic bridge accessory on which all other devices hang, it does not change over time
+func (b *Bridge) Root() *accessory.A {
+	return b.root.A
+}
+
+func (b *Bridge) newRoot() *accessory.Bridge {
+	root := accessory.NewBridge(accessory.Info{
 		Name:         "Kasa-Homekit Bridge",
 		SerialNumber: "1101",
 		Manufacturer: "cloudkucooland",
@@ -35,15 +91,15 @@ func Bridge() *accessory.A {
 	settings.S.AddC(settings.PollRate.C)
 	// causes a hang
 	/* settings.PollRate.OnValueRemoteUpdate(func(newstate int) {
-				log.Info.Printf("setting poll rate: %d", newstate)
-				pollInterval = time.Second * time.Duration(newstate)
+				slog.Info("setting poll rate", "seconds", newstate)
+				b.pollInterval = time.Second * time.Duration(newstate)
 		        // write to datastore
 	            // restart the poller (this is the hard part)
 			}) */
 
 	root.A.AddS(settings.S)
 
-	return root.A
+	return root
 }
 
 // add bridge-wide tunable parameters here
@@ -0,0 +1,194 @@
+package kasahkbridge
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudkucooland/HomeKitBridges/KasaHKBridge/kasasim"
+)
+
+// eventually polls cond until it holds or the deadline passes
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// mqttMessage is a command as paho would hand it over
+type mqttMessage struct {
+	topic, payload string
+}
+
+func (m mqttMessage) Duplicate() bool   { return false }
+func (m mqttMessage) Qos() byte         { return 1 }
+func (m mqttMessage) Retained() bool    { return false }
+func (m mqttMessage) Topic() string     { return m.topic }
+func (m mqttMessage) MessageID() uint16 { return 0 }
+func (m mqttMessage) Payload() []byte   { return []byte(m.payload) }
+func (m mqttMessage) Ack()              {}
+
+// simulated models, each on its own loopback address
+var simModels = []struct {
+	model string
+	ip    net.IP
+	slot  int // the outlet to switch, 0 on single relay devices
+}{
+	{"HS103(US)", net.IPv4(127, 0, 0, 41), 0},
+	{"HS220(US)", net.IPv4(127, 0, 0, 42), 0},
+	{"HS300(US)", net.IPv4(127, 0, 0, 43), 2},
+	{"KP115(US)", net.IPv4(127, 0, 0, 44), 0},
+	{"KP303(US)", net.IPv4(127, 0, 0, 45), 1},
+	{"KS200M(US)", net.IPv4(127, 0, 0, 46), 0},
+}
+
+func TestStartupWithSimulator(t *testing.T) {
+	// only probe the simulators, nothing goes out on the real interfaces. MQTT is never started, the commands are fed in
+	conf := &Config{Interfaces: []string{"none"}, MQTT: &MQTTConfig{Broker: "tcp://127.0.0.1:1883"}}
+	sims := make([]*kasasim.Device, 0, len(simModels))
+	for _, m := range simModels {
+		sim, err := kasasim.New(m.model, m.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sim.Listen(); err != nil {
+			t.Skipf("unable to listen on %s: %s", m.ip, err)
+		}
+		defer sim.Close()
+		sims = append(sims, sim)
+		conf.Targets = append(conf.Targets, m.ip.String())
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBridge(conf)
+	b.pollInterval = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	refresh := make(chan bool, 3)
+	go b.Listener(ctx, refresh)
+	defer func() {
+		cancel()
+		<-b.listenerDone
+	}()
+
+	if err := b.Startup(ctx, refresh, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(b.Devices()); got != len(simModels) {
+		t.Errorf("Devices() = %d accessories, want %d", got, len(simModels))
+	}
+
+	for i, m := range simModels {
+		sim := sims[i]
+		t.Run(m.model, func(t *testing.T) {
+			s := sim.Sysinfo()
+			b.kasasMu.RLock()
+			k, ok := b.kasas[s.DeviceID]
+			b.kasasMu.RUnlock()
+			if !ok {
+				t.Fatalf("simulated %s not discovered", s.DeviceID)
+			}
+
+			child := ""
+			if len(s.Children) > 0 {
+				child = s.Children[m.slot].ID
+			}
+
+			// a relay set from HomeKit reaches the device, and only the outlet asked for
+			if err := b.commandRelay(k, child, true, "homekit"); err != nil {
+				t.Fatal(err)
+			}
+			b.relaysMu.Lock()
+			remembered := b.relays[s.DeviceID][child]
+			b.relaysMu.Unlock()
+			if !remembered {
+				t.Error("relay set from HomeKit not remembered for after_outage")
+			}
+			eventually(t, "the simulator to switch on", func() bool { return sim.Relay(m.slot) })
+			if !k.relay(child) {
+				t.Error("relay not on after setRelay")
+			}
+			for _, c := range s.Children {
+				if c.ID != child && k.relay(c.ID) {
+					t.Errorf("outlet %s switched with %s", c.ID, child)
+				}
+			}
+
+			// a change on the device shows up at the next poll
+			sim.SetRelay(m.slot, false)
+			eventually(t, "the poll to see the relay off", func() bool { return !k.relay(child) })
+		})
+	}
+
+	// the extra services follow the device too
+	t.Run("HS220 brightness", func(t *testing.T) {
+		d, ok := b.findDevice(sims[1].Sysinfo().DeviceID).(dimmer)
+		if !ok {
+			t.Fatal("HS220 is not a dimmer")
+		}
+		if err := d.setBrightness(30, "homekit"); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, "the simulator brightness", func() bool { return sims[1].Sysinfo().Brightness == 30 })
+	})
+
+	// commands arrive on paho's goroutines while the Listener and poller are busy, -race checks they don't collide
+	t.Run("MQTT commands", func(t *testing.T) {
+		strip := sims[2].Sysinfo()
+		events := b.events.subscribe()
+		defer b.events.unsubscribe(events)
+
+		var wg sync.WaitGroup
+		for _, msg := range []mqttMessage{
+			{topic: "kasa/" + strip.DeviceID + "/" + strip.Children[4].ID + "/set", payload: "ON"},
+			{topic: "kasa/" + sims[1].Sysinfo().DeviceID + "/brightness/set", payload: "55"},
+			{topic: "kasa/" + sims[0].Sysinfo().DeviceID + "/set", payload: "ON"},
+		} {
+			wg.Go(func() { b.mqttCommand(nil, msg) })
+		}
+		wg.Wait()
+
+		eventually(t, "the strip outlet to switch on", func() bool { return sims[2].Relay(4) })
+		eventually(t, "the dimmer brightness", func() bool { return sims[1].Sysinfo().Brightness == 55 })
+		eventually(t, "the plug to switch on", func() bool { return sims[0].Relay(0) })
+
+		// the event says where the command came from, a poll may also report the change from the device
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type != "relay" || ev.DeviceID != strip.DeviceID || ev.Child != strip.Children[4].ID || ev.Source == "device" {
+					continue
+				}
+				if ev.Source != "mqtt" || ev.Value != true {
+					t.Errorf("relay event from %s with %v, want mqtt true", ev.Source, ev.Value)
+				}
+			case <-timeout:
+				t.Fatal("no mqtt relay event for the strip outlet")
+			}
+			break
+		}
+	})
+
+	t.Run("KP115 emeter", func(t *testing.T) {
+		sims[3].SetLoad(0, 500)
+		sims[3].SetRelay(0, true)
+		h := b.findDevice(sims[3].Sysinfo().DeviceID).(*KP115)
+		eventually(t, "the emeter to show the load", func() bool { return h.Outlet.Watt.Value() == 500 })
+	})
+
+	t.Run("KS200M light level", func(t *testing.T) {
+		sims[5].SetAmbient(42)
+		h := b.findDevice(sims[5].Sysinfo().DeviceID).(*KS200m)
+		eventually(t, "the raw light level", func() bool { return h.luxReport().Raw == 42 })
+	})
+}
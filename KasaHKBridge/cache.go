@@ -2,51 +2,54 @@ package kasahkbridge
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 
-	"github.com/brutella/hap/log"
 	"github.com/cloudkucooland/go-kasa"
 )
 
 const cachefilename = "startupcache.json"
 
-func SaveCache(path string) error {
+// SaveCache writes the sysinfo of every known device so the next start can offer them to HomeKit before discovery finishes
+func (b *Bridge) SaveCache(path string) error {
 	startupcache := make(map[string]kasa.Sysinfo)
 
 	fp := filepath.Join(path, cachefilename)
 	cache, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
 	if err != nil {
-		log.Info.Printf("unable to open file for startup cache: %s", err.Error())
+		slog.Warn("unable to open file for startup cache", "err", err)
 		return err
 	}
 	defer cache.Close()
 
 	encoder := json.NewEncoder(cache)
-	for id, k := range kasas {
+	b.kasasMu.RLock()
+	for id, k := range b.kasas {
 		startupcache[id] = k.sysinfo()
 	}
+	b.kasasMu.RUnlock()
 
 	if err := encoder.Encode(startupcache); err != nil {
-		log.Info.Printf("unable to encode startup cache: %s", err.Error())
+		slog.Warn("unable to encode startup cache", "err", err)
 		return err
 	}
 	return nil
 }
 
-func loadCache(path string) error {
+func (b *Bridge) loadCache(path string) error {
 	fp := filepath.Join(path, cachefilename)
 	cache, err := os.ReadFile(fp)
 	if err != nil {
-		log.Info.Printf("unable to open file for startup cache: %s", err.Error())
+		slog.Info("no startup cache", "err", err)
 		return err
 	}
 
 	startupcache := make(map[string]kasa.Sysinfo)
 
 	if err := json.Unmarshal(cache, &startupcache); err != nil {
-		log.Info.Printf("startup cache unmarshal failed: %s", err.Error())
+		slog.Warn("startup cache unmarshal failed", "err", err)
 		return err
 	}
 
@@ -58,20 +61,14 @@ func loadCache(path string) error {
 		kd := kasa.KasaDevice{}
 		kd.GetSysinfo.Sysinfo = k
 
-		switch kd.GetSysinfo.Sysinfo.Model {
-		case "HS103(US)":
-			kasas[id] = NewHS103(kd, ipd)
-		case "HS200(US)", "HS210(US)":
-			kasas[id] = NewHS200(kd, ipd)
-		case "HS220(US)":
-			kasas[id] = NewHS220(kd, ipd)
-		case "KP115(US)":
-			kasas[id] = NewKP115(kd, ipd)
-		case "KP303(US)":
-			kasas[id] = NewKP303(kd, ipd)
-		case "HS300(US)":
-			kasas[id] = NewHS300(kd, ipd)
+		factory, ok := deviceFactories[kd.GetSysinfo.Sysinfo.Model]
+		if !ok {
+			slog.Warn("unknown device type in startup cache", "model", kd.GetSysinfo.Sysinfo.Model, "id", id)
+			continue
 		}
+		b.kasasMu.Lock()
+		b.kasas[id] = factory(b, kd, ipd)
+		b.kasasMu.Unlock()
 		ip++
 	}
 	return nil
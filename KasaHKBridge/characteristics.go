@@ -66,6 +66,9 @@ func NewAmp() *amp {
 // ramp rate     E8700114
 // min threshold E8700115
 // RSSI          E8700116
+// PIR enable    E8700117
+// PIR range     E8700118
+// PIR cold time E8700119
 
 type fadeOnTime struct {
 	*characteristic.Int
@@ -185,3 +188,53 @@ func NewRSSI() *rssi {
 
 	return &rssi{c}
 }
+
+type pirEnable struct {
+	*characteristic.Bool
+}
+
+// NewPIREnable is the KS200M "motion turns the light on" setting
+func NewPIREnable() *pirEnable {
+	c := characteristic.NewBool("E8700117-079E-48FF-8F27-9C2605A29F52")
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionWrite, characteristic.PermissionEvents}
+	c.Description = "Motion Activates"
+	c.SetValue(true)
+
+	return &pirEnable{c}
+}
+
+type pirRange struct {
+	*characteristic.Int
+}
+
+// NewPIRRange is the KS200M sensitivity, 0 far, 1 mid, 2 near
+func NewPIRRange() *pirRange {
+	c := characteristic.NewInt("E8700118-079E-48FF-8F27-9C2605A29F52")
+	c.Format = characteristic.FormatUInt8
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionWrite, characteristic.PermissionEvents}
+	c.Description = "Motion Range"
+	c.SetMinValue(0)
+	c.SetMaxValue(2)
+	c.SetStepValue(1)
+	_ = c.SetValue(1)
+
+	return &pirRange{c}
+}
+
+type pirColdTime struct {
+	*characteristic.Int
+}
+
+// NewPIRColdTime is how long the KS200M leaves the light on after the last motion
+func NewPIRColdTime() *pirColdTime {
+	c := characteristic.NewInt("E8700119-079E-48FF-8F27-9C2605A29F52")
+	c.Format = characteristic.FormatUInt32
+	c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionWrite, characteristic.PermissionEvents}
+	c.Description = "Motion Off Delay"
+	c.Unit = "seconds"
+	c.SetMinValue(0)
+	c.SetMaxValue(3600)
+	_ = c.SetValue(60)
+
+	return &pirColdTime{c}
+}
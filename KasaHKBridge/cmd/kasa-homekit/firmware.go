@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudkucooland/HomeKitBridges/KasaHKBridge"
+)
+
+// firmware asks the running bridge for its inventory and prints it grouped by model and firmware
+func firmware(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("the admin interface is disabled, set admin_addr in the config")
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/firmware", addr))
+	if err != nil {
+		return fmt.Errorf("is the bridge running? %w", err)
+	}
+	defer resp.Body.Close()
+
+	var inventory []kasahkbridge.FirmwareGroup
+	if err := json.NewDecoder(resp.Body).Decode(&inventory); err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, g := range inventory {
+		fmt.Printf("%s hw %s fw %s (%d)\n", g.Model, g.HWVersion, g.SWVersion, len(g.Devices))
+		for _, d := range g.Devices {
+			if d.PreviousSWVersion != "" {
+				fmt.Printf("\t%-30s %-15s CHANGED from %s\n", d.Alias, d.IP, d.PreviousSWVersion)
+				changed++
+				continue
+			}
+			fmt.Printf("\t%-30s %s\n", d.Alias, d.IP)
+		}
+	}
+	if changed > 0 {
+		fmt.Printf("%d devices changed firmware since the last run\n", changed)
+	}
+	return nil
+}
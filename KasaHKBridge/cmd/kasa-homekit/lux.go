@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudkucooland/HomeKitBridges/KasaHKBridge"
+)
+
+// lux prints the last light reading of a KS200M from the running bridge, with a reference adds it to the calibration in the config
+func lux(addr, filename, device string, reference *float64) error {
+	if addr == "" {
+		return fmt.Errorf("the admin interface is disabled, set admin_addr in the config")
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/lux/%s", addr, url.PathEscape(device)))
+	if err != nil {
+		return fmt.Errorf("is the bridge running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", device, resp.Status)
+	}
+
+	var r kasahkbridge.LuxReport
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	fmt.Printf("%s raw %d reported as %.1f lux\n", r.Alias, r.Raw, r.Lux)
+
+	if reference == nil {
+		return nil
+	}
+	if err := addLuxPoint(filename, r, *reference); err != nil {
+		return err
+	}
+	fmt.Printf("added raw %d = %.1f lux to %s, restart the bridge to use it\n", r.Raw, *reference, filename)
+	return nil
+}
+
+// addLuxPoint edits the config as plain JSON so the settings the bridge doesn't know about are left alone
+func addLuxPoint(filename string, r kasahkbridge.LuxReport, reference float64) error {
+	raw, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c := make(map[string]any)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+	}
+
+	// encoding/json matches keys without regard to case, so an older "Devices" is still the devices
+	devicesKey := "devices"
+	for k := range c {
+		if strings.EqualFold(k, devicesKey) {
+			devicesKey = k
+		}
+	}
+	devices, _ := c[devicesKey].(map[string]any)
+	if devices == nil {
+		devices = make(map[string]any)
+		c[devicesKey] = devices
+	}
+
+	// use the existing entry for the device if there is one
+	key := r.DeviceID
+	if _, ok := devices[key]; !ok {
+		if _, ok := devices[r.Alias]; ok {
+			key = r.Alias
+		}
+	}
+	d, _ := devices[key].(map[string]any)
+	if d == nil {
+		d = make(map[string]any)
+		devices[key] = d
+	}
+	l, _ := d["lux"].(map[string]any)
+	if l == nil {
+		l = make(map[string]any)
+		d["lux"] = l
+	}
+
+	// a new reading at the same raw level replaces the old one
+	var points []any
+	existing, _ := l["points"].([]any)
+	for _, p := range existing {
+		if pm, ok := p.(map[string]any); ok {
+			if pr, ok := pm["raw"].(float64); ok && uint(pr) == r.Raw {
+				continue
+			}
+		}
+		points = append(points, p)
+	}
+	l["points"] = append(points, kasahkbridge.LuxPoint{Raw: r.Raw, Lux: reference})
+
+	out, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+
+	// make sure the bridge will still load it
+	var check kasahkbridge.Config
+	if err := json.Unmarshal(out, &check); err != nil {
+		return err
+	}
+	if err := check.Validate(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, out, 0644)
+}
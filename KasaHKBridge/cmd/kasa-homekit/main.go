@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"syscall"
 
 	"github.com/cloudkucooland/HomeKitBridges/KasaHKBridge"
 
 	"github.com/brutella/hap"
-	"github.com/brutella/hap/log"
+	hlog "github.com/brutella/hap/log"
 
 	"github.com/urfave/cli/v2"
 
@@ -20,7 +23,8 @@ import (
 
 // TODO dump cli and use the native flag type
 func main() {
-	var dir string
+	var dir, file, level string
+	var logJSON bool
 
 	app := cli.App{
 		Name:  "Kasa homekit bridge",
@@ -32,18 +36,82 @@ func main() {
 				Usage:       "configuration directory",
 				Destination: &dir,
 			},
+			&cli.StringFlag{
+				Name:        "config",
+				Value:       "kasa.json",
+				Usage:       "configuration file",
+				Destination: &file,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Value:       "info",
+				Usage:       "debug, info, warn or error",
+				Destination: &level,
+			},
+			&cli.BoolFlag{
+				Name:        "log-json",
+				Usage:       "log as JSON, one object per line",
+				Destination: &logJSON,
+			},
+		},
+		Before: func(c *cli.Context) error {
+			return setupLogging(level, logJSON)
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "firmware",
+				Usage: "list the devices of the running bridge grouped by model and firmware",
+				Action: func(c *cli.Context) error {
+					conf, err := kasahkbridge.LoadConfig(filepath.Join(dir, file))
+					if conf == nil {
+						return err
+					}
+					return firmware(conf.AdminAddr)
+				},
+			},
+			{
+				Name:      "lux",
+				Usage:     "show the raw light level of a KS200M, with a lux meter reading add it to the calibration in the config",
+				ArgsUsage: "<DeviceID or alias> [lux]",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("which device?")
+					}
+					fp := filepath.Join(dir, file)
+					conf, err := kasahkbridge.LoadConfig(fp)
+					if conf == nil {
+						return err
+					}
+
+					var reference *float64
+					if c.NArg() > 1 {
+						l, err := strconv.ParseFloat(c.Args().Get(1), 64)
+						if err != nil || l < 0 {
+							return fmt.Errorf("invalid lux: %s", c.Args().Get(1))
+						}
+						reference = &l
+					}
+					return lux(conf.AdminAddr, fp, c.Args().First(), reference)
+				},
+			},
 		},
 		Action: func(c *cli.Context) error {
 			fulldir, err := filepath.Abs(dir)
 			if err != nil {
-				log.Info.Panic("unable to get config directory", dir)
+				return fmt.Errorf("unable to get config directory %s: %w", dir, err)
+			}
+
+			// the config file is optional
+			conf, err := kasahkbridge.LoadConfig(filepath.Join(fulldir, file))
+			if conf == nil {
+				return err
 			}
 
 			// listen for interface status changes
 			var linkstatuschan = make(chan netlink.LinkUpdate, 5)
 			var disconnectchan = make(chan struct{})
 			if err := netlink.LinkSubscribe(linkstatuschan, disconnectchan); err != nil {
-				log.Info.Panic(err.Error())
+				return fmt.Errorf("unable to watch interfaces: %w", err)
 			}
 
 			// wait for signal to shut down
@@ -51,36 +119,42 @@ func main() {
 			signal.Notify(sigch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
 
 			refresh := make(chan bool, 3)
+			kasa := kasahkbridge.NewBridge(conf)
 
 			// start the UDP listener before anything else
 			listenctx, listencancel := context.WithCancel(context.Background())
+			defer listencancel()
 			var listenwaitgroup sync.WaitGroup
 			listenwaitgroup.Go(func() {
-				kasahkbridge.Listener(listenctx, refresh)
+				kasa.Listener(listenctx, refresh)
 			})
 
-			if err = kasahkbridge.SetBroadcasts(); err != nil {
-				log.Info.Panic(err)
-			}
-
-			// discover & provision the devices
+			// discover & provision the devices, opening the per-interface discovery sockets
 			// cache gets loaded before first broadcast
-			if err = kasahkbridge.Startup(listenctx, refresh, dir); err != nil {
-				log.Info.Panic(err)
+			if err = kasa.Startup(listenctx, refresh, dir); err != nil {
+				return err
 			}
 
+			listenwaitgroup.Go(func() {
+				kasa.AdminServer(listenctx)
+			})
+			listenwaitgroup.Go(func() {
+				kasa.MQTT(listenctx)
+			})
+
 			// does not change over time
-			bridge := kasahkbridge.Bridge()
+			bridge := kasa.Root()
 			var hapwaitgroup sync.WaitGroup
 
 		DONE:
 			for {
 				hapctx, hapcancel := context.WithCancel(context.Background())
-				devices := kasahkbridge.Devices()
-				log.Info.Printf("serving %d kasa devices", len(devices))
+				devices := kasa.Devices()
+				slog.Info("serving kasa devices", "devices", len(devices))
 				hapserver, err := hap.NewServer(hap.NewFsStore(fulldir), bridge, devices...)
 				if err != nil {
-					log.Info.Panic(err)
+					hapcancel()
+					return err
 				}
 
 				// serve HomeKit
@@ -88,43 +162,68 @@ func main() {
 					hapserver.ListenAndServe(hapctx)
 				})
 
-				select {
-				case <-refresh:
-					log.Info.Printf("new device discovered, restarting")
-					for len(refresh) > 0 {
-						<-refresh
-						log.Info.Printf("draining refresh queue")
+			SERVE:
+				for {
+					select {
+					case <-refresh:
+						slog.Info("new device discovered, restarting")
+						for len(refresh) > 0 {
+							<-refresh
+							slog.Debug("draining refresh queue")
+						}
+						hapcancel()
+						hapwaitgroup.Wait()
+						// loop back around, getting updated device list
+						break SERVE
+					case <-listenctx.Done():
+						slog.Info("shutdown: context canceled")
+						hapcancel()
+						hapwaitgroup.Wait()
+						break DONE
+					case sig := <-sigch:
+						slog.Info("shutdown requested by signal", "signal", sig.String())
+						hapcancel()
+						hapwaitgroup.Wait()
+						break DONE
+					case <-linkstatuschan:
+						// the device list is the same, HomeKit keeps running
+						if err := kasa.SetBroadcasts(); err != nil {
+							slog.Warn("interface change, unable to update broadcast addresses", "err", err)
+						}
 					}
-					hapcancel()
-					hapwaitgroup.Wait()
-					// loop back around, getting updated device list
-				case <-listenctx.Done():
-					log.Info.Printf("shutdown: context canceled")
-					hapcancel()
-					hapwaitgroup.Wait()
-					break DONE
-				case sig := <-sigch:
-					log.Info.Printf("shutdown requested by signal: %s", sig)
-					hapcancel()
-					hapwaitgroup.Wait()
-					break DONE
-				case <-linkstatuschan:
-					log.Info.Printf("interface change, updating broadcast addresses")
-					_ = kasahkbridge.SetBroadcasts()
-					hapcancel()
-					hapwaitgroup.Wait()
-					// loop back around
 				}
 			}
 			close(disconnectchan)
 			listencancel()
 			listenwaitgroup.Wait()
-			kasahkbridge.SaveCache(fulldir)
+			kasa.SaveCache(fulldir)
 			return nil
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		log.Info.Panic(err)
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// setupLogging sends everything, including hap's own messages, through one slog handler so the output is all text or all JSON
+func setupLogging(level string, asJSON bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %s", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if asJSON {
+		h = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(h))
+
+	hlog.Info = &hlog.Logger{Logger: slog.NewLogLogger(h, slog.LevelInfo)}
+	if l <= slog.LevelDebug {
+		hlog.Debug = &hlog.Logger{Logger: slog.NewLogLogger(h, slog.LevelDebug)}
 	}
+	return nil
 }
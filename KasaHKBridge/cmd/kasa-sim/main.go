@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cloudkucooland/HomeKitBridges/KasaHKBridge/kasasim"
+
+	"github.com/urfave/cli/v2"
+)
+
+// runs one simulated device of each model on consecutive loopback addresses
+func main() {
+	var base string
+
+	app := cli.App{
+		Name:  "Kasa device simulator",
+		Usage: "simulate Kasa devices for testing the bridge",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "base",
+				Value:       "127.0.0.2",
+				Usage:       "first address to listen on, each device gets the next one",
+				Destination: &base,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			ip := net.ParseIP(base).To4()
+			if ip == nil {
+				return fmt.Errorf("invalid base address: %s", base)
+			}
+
+			models := kasasim.Models
+			if c.NArg() > 0 {
+				models = c.Args().Slice()
+			}
+
+			for _, model := range models {
+				d, err := kasasim.New(model, ip)
+				if err != nil {
+					return err
+				}
+				if err := d.Listen(); err != nil {
+					return err
+				}
+				defer d.Close()
+
+				s := d.Sysinfo()
+				slog.Info("simulating", "model", s.Model, "id", s.DeviceID, "ip", ip.String())
+
+				next := make(net.IP, len(ip))
+				copy(next, ip)
+				next[3]++
+				ip = next
+			}
+
+			sigch := make(chan os.Signal, 3)
+			signal.Notify(sigch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+			sig := <-sigch
+			slog.Info("shutdown requested by signal", "signal", sig.String())
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,226 @@
+package kasahkbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// Config is the optional kasa.json in the configuration directory
+type Config struct {
+	AdminAddr string                  `json:"admin_addr"`           // ip:port for the admin interface, "" to disable (127.0.0.1:8998)
+	LEDSwitch bool                    `json:"led_switch,omitempty"` // add a switch for the status LED to every device
+	Devices   map[string]DeviceConfig `json:"devices,omitempty"`    // keyed by DeviceID or by the alias on the device
+	Groups    map[string]GroupConfig  `json:"groups,omitempty"`     // keyed by the name shown in HomeKit
+	MQTT      *MQTTConfig             `json:"mqtt,omitempty"`       // publish to an MQTT broker, unset to disable
+
+	// limit discovery, empty lists allow everything
+	Interfaces       []string `json:"interfaces,omitempty"`        // interface names to discover on (eth0)
+	IgnoreInterfaces []string `json:"ignore_interfaces,omitempty"` // interface names to never discover on (docker0)
+	Subnets          []string `json:"subnets,omitempty"`           // CIDRs to discover on (192.168.1.0/24)
+	IgnoreSubnets    []string `json:"ignore_subnets,omitempty"`    // CIDRs to never discover on
+	Targets          []string `json:"targets,omitempty"`           // addresses to probe directly, for routed networks or the simulator (127.0.0.2)
+
+	subnets       []*net.IPNet
+	ignoreSubnets []*net.IPNet
+	targets       []net.IP
+}
+
+// GroupConfig makes several devices or outlets act as one accessory
+type GroupConfig struct {
+	Type    string   `json:"type,omitempty"` // "switch" (default) or "lightbulb"
+	Members []string `json:"members"`        // DeviceID or alias, for strips the outlet alias or DeviceID+child ID
+	Mode    string   `json:"mode,omitempty"` // the group is on if "any" (default) or "all" members are on
+}
+
+// MQTTConfig connects the bridge to a broker, for Home Assistant and the like
+type MQTTConfig struct {
+	Broker          string `json:"broker"`              // tcp://192.168.1.2:1883, ssl:// for TLS
+	ClientID        string `json:"client_id,omitempty"` // (kasa-homekit)
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`           // topics are prefix/DeviceID/... (kasa)
+	Discovery       bool   `json:"discovery,omitempty"`        // publish Home Assistant discovery configs
+	DiscoveryPrefix string `json:"discovery_prefix,omitempty"` // (homeassistant)
+}
+
+// DeviceConfig is per device, the device-side settings are pushed the first time it responds after startup
+type DeviceConfig struct {
+	Alias         string `json:"alias,omitempty"`   // name stored on the device
+	LEDOff        *bool  `json:"led_off,omitempty"` // status LED, unset leaves it alone
+	Cloud         string `json:"cloud,omitempty"`   // "bind", "unbind" or "" to leave it alone
+	CloudUsername string `json:"cloud_username,omitempty"`
+	CloudPassword string `json:"cloud_password,omitempty"`
+	LEDSwitch     *bool  `json:"led_switch,omitempty"`   // overrides the bridge-wide LEDSwitch
+	AfterOutage   string `json:"after_outage,omitempty"` // "restore" (default), "on", "off" or "none"
+
+	Appliance *ApplianceConfig `json:"appliance,omitempty"` // KP115 only
+	Lux       *LuxConfig       `json:"lux,omitempty"`       // KS200M only
+}
+
+// ApplianceConfig derives a running/done sensor from the power draw
+type ApplianceConfig struct {
+	Sensor     string  `json:"sensor,omitempty"` // "occupancy" (default) or "contact"
+	Name       string  `json:"name,omitempty"`   // shown in HomeKit (Running)
+	OnWatts    float64 `json:"on_watts"`         // running once above this...
+	OnSeconds  int     `json:"on_seconds"`       // ...for this long
+	OffWatts   float64 `json:"off_watts"`        // done once below this...
+	OffSeconds int     `json:"off_seconds"`      // ...for this long
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	c := Config{
+		AdminAddr: "127.0.0.1:8998",
+		Devices:   make(map[string]DeviceConfig),
+	}
+
+	confFile, err := os.Open(filename)
+	if err != nil {
+		slog.Info("unable to open config, using defaults", "file", filename, "err", err)
+		return &c, err
+	}
+	defer confFile.Close()
+
+	raw, err := io.ReadAll(confFile)
+	if err != nil {
+		slog.Warn("unable to read config, using defaults", "file", filename, "err", err)
+		return &c, err
+	}
+
+	err = json.Unmarshal(raw, &c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+
+	return &c, nil
+}
+
+// Validate checks the device settings before anything is sent to a device
+func (c *Config) Validate() error {
+	c.subnets = c.subnets[:0]
+	for _, cidr := range c.Subnets {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid subnet: %w", err)
+		}
+		c.subnets = append(c.subnets, n)
+	}
+
+	c.ignoreSubnets = c.ignoreSubnets[:0]
+	for _, cidr := range c.IgnoreSubnets {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid ignored subnet: %w", err)
+		}
+		c.ignoreSubnets = append(c.ignoreSubnets, n)
+	}
+
+	c.targets = c.targets[:0]
+	for _, t := range c.Targets {
+		ip := net.ParseIP(t)
+		if ip == nil {
+			return fmt.Errorf("invalid target address: %s", t)
+		}
+		c.targets = append(c.targets, ip)
+	}
+
+	for name, d := range c.Devices {
+		switch d.Cloud {
+		case "", "unbind":
+		case "bind":
+			if d.CloudUsername == "" || d.CloudPassword == "" {
+				return fmt.Errorf("device %s: cloud bind requires cloud_username and cloud_password", name)
+			}
+		default:
+			return fmt.Errorf("device %s: unsupported cloud setting '%s'", name, d.Cloud)
+		}
+
+		switch d.AfterOutage {
+		case "", "restore", "on", "off", "none":
+		default:
+			return fmt.Errorf("device %s: unsupported after_outage '%s'", name, d.AfterOutage)
+		}
+
+		if d.Lux != nil {
+			if err := d.Lux.validate(); err != nil {
+				return fmt.Errorf("device %s: %w", name, err)
+			}
+		}
+
+		if a := d.Appliance; a != nil {
+			switch a.Sensor {
+			case "", "occupancy", "contact":
+			default:
+				return fmt.Errorf("device %s: unsupported appliance sensor '%s'", name, a.Sensor)
+			}
+			if a.OnWatts <= 0 || a.OffWatts < 0 || a.OffWatts > a.OnWatts {
+				return fmt.Errorf("device %s: appliance needs on_watts above zero and off_watts no higher than on_watts", name)
+			}
+			if a.OnSeconds < 0 || a.OffSeconds < 0 {
+				return fmt.Errorf("device %s: appliance on_seconds and off_seconds can not be negative", name)
+			}
+		}
+	}
+
+	if m := c.MQTT; m != nil {
+		if m.Broker == "" {
+			return fmt.Errorf("mqtt: no broker")
+		}
+		if m.ClientID == "" {
+			m.ClientID = "kasa-homekit"
+		}
+		m.Prefix = strings.Trim(m.Prefix, "/")
+		if m.Prefix == "" {
+			m.Prefix = "kasa"
+		}
+		if strings.ContainsAny(m.Prefix, "+#") {
+			return fmt.Errorf("mqtt: prefix can not contain wildcards")
+		}
+		m.DiscoveryPrefix = strings.Trim(m.DiscoveryPrefix, "/")
+		if m.DiscoveryPrefix == "" {
+			m.DiscoveryPrefix = "homeassistant"
+		}
+	}
+
+	for name, g := range c.Groups {
+		switch g.Type {
+		case "", "switch", "lightbulb":
+		default:
+			return fmt.Errorf("group %s: unsupported type '%s'", name, g.Type)
+		}
+		switch g.Mode {
+		case "", "any", "all":
+		default:
+			return fmt.Errorf("group %s: unsupported mode '%s'", name, g.Mode)
+		}
+		if len(g.Members) == 0 {
+			return fmt.Errorf("group %s: no members", name)
+		}
+	}
+	return nil
+}
+
+// ledSwitch reports if the device gets a switch for the status LED
+func (c *Config) ledSwitch(id, alias string) bool {
+	if d, ok := c.device(id, alias); ok && d.LEDSwitch != nil {
+		return *d.LEDSwitch
+	}
+	return c.LEDSwitch
+}
+
+// device looks up the settings by DeviceID first, then by alias
+func (c *Config) device(id, alias string) (DeviceConfig, bool) {
+	if d, ok := c.Devices[id]; ok {
+		return d, true
+	}
+	d, ok := c.Devices[alias]
+	return d, ok
+}
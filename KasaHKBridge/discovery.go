@@ -0,0 +1,198 @@
+package kasahkbridge
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+// ifaceConn is a discovery socket bound to one interface address
+type ifaceConn struct {
+	name      string
+	network   *net.IPNet
+	broadcast net.IP
+	conn      *net.UDPConn
+}
+
+// packet is an unscrambled response from any of the sockets, handled in Listener
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// SetBroadcasts opens a discovery socket on each new interface address and closes those that went away, it is safe to call on every link change
+func (b *Bridge) SetBroadcasts() error {
+	slog.Debug("updating broadcasts")
+
+	current, err := b.interfaceAddresses()
+	if err != nil {
+		return err
+	}
+
+	b.ifacesMu.Lock()
+	defer b.ifacesMu.Unlock()
+
+	for local, i := range b.ifaces {
+		if _, ok := current[local]; !ok {
+			slog.Info("stopping discovery", "interface", i.name, "local", local)
+			i.conn.Close()
+			delete(b.ifaces, local)
+		}
+	}
+
+	for local, i := range current {
+		if _, ok := b.ifaces[local]; ok {
+			continue
+		}
+
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: i.network.IP, Port: 0})
+		if err != nil {
+			slog.Warn("unable to listen", "interface", i.name, "local", local, "err", err)
+			continue
+		}
+		i.conn = conn
+		b.ifaces[local] = i
+		slog.Info("discovering", "interface", i.name, "local", local, "broadcast", i.broadcast.String())
+		go b.readPackets(conn)
+
+		// find anything on the new network now rather than at the next poll
+		if _, err := conn.WriteToUDP(discoverCmd, &net.UDPAddr{IP: i.broadcast, Port: 9999}); err != nil {
+			slog.Warn("discovery failed", "broadcast", i.broadcast.String(), "err", err)
+		}
+	}
+	return nil
+}
+
+// interfaceAddresses finds the IPv4 broadcast domains allowed by the config
+func (b *Bridge) interfaceAddresses() (map[string]*ifaceConn, error) {
+	found := make(map[string]*ifaceConn)
+
+	nics, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nic := range nics {
+		if nic.Flags&net.FlagUp == 0 || nic.Flags&net.FlagBroadcast == 0 || nic.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if !b.conf.interfaceAllowed(nic.Name) {
+			continue
+		}
+
+		addrs, err := nic.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !b.conf.subnetAllowed(ipNet.IP) {
+				continue
+			}
+
+			// Kasa devices only speak IPv4 and IPv6 has no broadcast to discover them with
+			v4 := ipNet.IP.To4()
+			if v4 == nil {
+				slog.Debug("skipping IPv6 address", "interface", nic.Name, "address", ipNet.IP.String())
+				continue
+			}
+
+			mask := ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for j := range bcast {
+				bcast[j] = v4[j] | ^mask[j]
+			}
+
+			found[v4.String()] = &ifaceConn{
+				name:      nic.Name,
+				network:   &net.IPNet{IP: v4, Mask: mask},
+				broadcast: bcast,
+			}
+		}
+	}
+	return found, nil
+}
+
+func (c *Config) interfaceAllowed(name string) bool {
+	if slices.Contains(c.IgnoreInterfaces, name) {
+		return false
+	}
+	return len(c.Interfaces) == 0 || slices.Contains(c.Interfaces, name)
+}
+
+func (c *Config) subnetAllowed(ip net.IP) bool {
+	for _, n := range c.ignoreSubnets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.subnets) == 0 {
+		return true
+	}
+	for _, n := range c.subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPackets feeds the Listener until the socket is closed
+func (b *Bridge) readPackets(conn *net.UDPConn) {
+	buffer := make([]byte, bufsize)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		// Unscramble works in place and the buffer is reused for the next read
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+
+		select {
+		case b.packets <- packet{data: kasa.Unscramble(data), addr: addr}:
+		case <-b.listenerDone:
+			return
+		}
+	}
+}
+
+func (b *Bridge) closeInterfaces() {
+	b.ifacesMu.Lock()
+	defer b.ifacesMu.Unlock()
+
+	for local, i := range b.ifaces {
+		i.conn.Close()
+		delete(b.ifaces, local)
+	}
+}
+
+func (b *Bridge) discover() {
+	b.ifacesMu.Lock()
+	defer b.ifacesMu.Unlock()
+
+	for _, i := range b.ifaces {
+		if _, err := i.conn.WriteToUDP(discoverCmd, &net.UDPAddr{IP: i.broadcast, Port: 9999}); err != nil {
+			slog.Warn("discovery failed", "broadcast", i.broadcast.String(), "err", err)
+			continue
+		}
+	}
+
+	// replies come back to the Listener
+	if b.packetconn == nil {
+		return
+	}
+	for _, t := range b.conf.targets {
+		if _, err := b.packetconn.WriteToUDP(discoverCmd, &net.UDPAddr{IP: t, Port: 9999}); err != nil {
+			slog.Warn("discovery failed", "target", t.String(), "err", err)
+		}
+	}
+}
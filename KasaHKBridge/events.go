@@ -0,0 +1,87 @@
+package kasahkbridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+// Event is one state change, streamed from /events
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"` // relay, brightness, emeter, reachable, ip
+	DeviceID string    `json:"device_id"`
+	Alias    string    `json:"alias"`
+	Child    string    `json:"child,omitempty"` // outlet on a strip
+	Source   string    `json:"source"`          // device, homekit, mqtt, group, restore or cutoff
+	Value    any       `json:"value"`
+}
+
+// EmeterValue is the Value of an emeter event
+type EmeterValue struct {
+	VoltageMV uint `json:"voltage_mv"`
+	CurrentMA uint `json:"current_ma"`
+	PowerMW   uint `json:"power_mw"`
+	TotalWH   uint `json:"total_wh"`
+}
+
+// eventBus fans events out to the subscribers, a subscriber that falls behind misses events rather than stalling the bridge
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func (e *eventBus) subscribe() chan Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.subs == nil {
+		e.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, 64)
+	e.subs[ch] = struct{}{}
+	return ch
+}
+
+func (e *eventBus) unsubscribe(ch chan Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.subs, ch)
+}
+
+func (e *eventBus) publish(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publish sends an event for the device
+func (g *generic) publish(typ, child, source string, value any) {
+	s := g.sysinfo()
+	g.b.events.publish(Event{
+		Time:     time.Now(),
+		Type:     typ,
+		DeviceID: s.DeviceID,
+		Alias:    s.Alias,
+		Child:    child,
+		Source:   source,
+		Value:    value,
+	})
+}
+
+func (g *generic) publishEmeter(child string, e kasa.EmeterRealtime) {
+	g.publish("emeter", child, "device", EmeterValue{
+		VoltageMV: e.VoltageMV,
+		CurrentMA: e.CurrentMA,
+		PowerMW:   e.PowerMW,
+		TotalWH:   e.TotalWH,
+	})
+}
@@ -0,0 +1,62 @@
+package kasahkbridge
+
+import (
+	"sort"
+)
+
+// FirmwareEntry is one device in the firmware inventory
+type FirmwareEntry struct {
+	DeviceID          string `json:"device_id"`
+	Alias             string `json:"alias"`
+	IP                string `json:"ip"`
+	PreviousSWVersion string `json:"previous_sw_version,omitempty"` // set if the firmware changed since the last run
+}
+
+// FirmwareGroup is every device running the same firmware on the same hardware
+type FirmwareGroup struct {
+	Model     string          `json:"model"`
+	HWVersion string          `json:"hw_version"`
+	SWVersion string          `json:"sw_version"`
+	Devices   []FirmwareEntry `json:"devices"`
+}
+
+// Firmware returns the inventory grouped by model, hardware and firmware version
+func (b *Bridge) Firmware() []FirmwareGroup {
+	groups := make(map[[3]string]*FirmwareGroup)
+
+	b.kasasMu.RLock()
+	for _, k := range b.kasas {
+		s := k.sysinfo()
+		key := [3]string{s.Model, s.HWVersion, s.SWVersion}
+		g, ok := groups[key]
+		if !ok {
+			g = &FirmwareGroup{Model: s.Model, HWVersion: s.HWVersion, SWVersion: s.SWVersion}
+			groups[key] = g
+		}
+		g.Devices = append(g.Devices, FirmwareEntry{
+			DeviceID:          s.DeviceID,
+			Alias:             s.Alias,
+			IP:                k.getIPstring(),
+			PreviousSWVersion: k.previousFirmware(),
+		})
+	}
+	b.kasasMu.RUnlock()
+
+	inventory := make([]FirmwareGroup, 0, len(groups))
+	for _, g := range groups {
+		sort.Slice(g.Devices, func(i, j int) bool {
+			return g.Devices[i].Alias < g.Devices[j].Alias
+		})
+		inventory = append(inventory, *g)
+	}
+	sort.Slice(inventory, func(i, j int) bool {
+		if inventory[i].Model != inventory[j].Model {
+			return inventory[i].Model < inventory[j].Model
+		}
+		if inventory[i].HWVersion != inventory[j].HWVersion {
+			return inventory[i].HWVersion < inventory[j].HWVersion
+		}
+		return inventory[i].SWVersion < inventory[j].SWVersion
+	})
+	return inventory
+}
@@ -2,12 +2,16 @@ package kasahkbridge
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
+	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
 )
@@ -15,12 +19,22 @@ import (
 // included in all device types
 type generic struct {
 	*accessory.A
+	b            *Bridge   // the bridge the device was found by
 	lastUpdate   time.Time // last time the device responded
 	RSSI         *rssi
 	StatusActive *characteristic.StatusActive
 	StatusFault  *characteristic.StatusFault
+	LED          *ledSvc // optional, nil unless configured
 	ip           net.IP
 	Sysinfo      kasa.Sysinfo // contents of the last response from the device
+	applied      bool         // device-side config has been pushed
+	wifi         wifiStats
+	prevSWVer    string // firmware before it changed, either since the last run or while running
+	outage       bool   // lost power while unreachable, after_outage not yet applied
+
+	// mu guards ip, Sysinfo, lastUpdate and prevSWVer. The Listener is the only writer and reads them directly,
+	// HomeKit, MQTT, the poller and the admin API go through the accessors.
+	mu sync.RWMutex
 }
 
 func (g *generic) getA() *accessory.A {
@@ -28,32 +42,71 @@ func (g *generic) getA() *accessory.A {
 }
 
 func (g *generic) getLastUpdate() time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	return g.lastUpdate
 }
 
 func (g *generic) sysinfo() kasa.Sysinfo {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	return g.Sysinfo
 }
 
+func (g *generic) getIP() net.IP {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.ip
+}
+
+// logger tags the messages with the device, so they can be picked out of the journal
+func (g *generic) logger() *slog.Logger {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return slog.With("alias", g.Sysinfo.Alias, "id", g.Sysinfo.DeviceID, "ip", g.ip.String())
+}
+
+func (g *generic) reachable() bool {
+	return g.StatusActive.Value()
+}
+
 func (g *generic) unreachable() {
 	if !g.StatusActive.Value() {
 		return
 	}
 
-	log.Info.Printf("[%s] has not responded", g.Sysinfo.Alias)
+	g.logger().Warn("has not responded")
 	g.StatusActive.SetValue(false)
 	g.StatusFault.SetValue(characteristic.StatusFaultGeneralFault)
+	g.publish("reachable", "", "device", false)
 
 	// try conecting using a TCP connection to see if it is really down or just dropping UDP
-	k, err := newKasaIP(g.ip)
+	k, err := g.b.newKasaIP(g.getIP())
 	if err != nil {
-		log.Info.Println(err.Error())
+		g.logger().Warn("unable to reach over TCP", "err", err)
 		return
 	}
-	if _, err := k.GetWIFIStatus(); err != nil {
-		log.Info.Println(err.Error())
+	sta, err := k.GetWIFIStatus()
+	if err != nil {
+		g.logger().Warn("not answering TCP either", "err", err)
+		g.wifi.lost(false)
 		return
 	}
+	g.logger().Warn("answering TCP but not UDP", "rssi", sta.RSSI)
+	g.wifi.lost(true)
+	g.wifi.sample(sta.RSSI, true)
+}
+
+func (g *generic) wifiReport(history bool) WifiReport {
+	s := g.sysinfo()
+	r := WifiReport{
+		DeviceID:  s.DeviceID,
+		Alias:     s.Alias,
+		IP:        g.getIPstring(),
+		Reachable: g.StatusActive.Value(),
+	}
+	g.wifi.report(&r, history)
+	return r
 }
 
 func (g *generic) configure(k kasa.Sysinfo, ip net.IP) accessory.Info {
@@ -82,7 +135,7 @@ func (g *generic) configure(k kasa.Sysinfo, ip net.IP) accessory.Info {
 func (g *generic) setID() {
 	mac, err := hex.DecodeString(g.Sysinfo.DeviceID[:12])
 	if err != nil {
-		log.Info.Printf("weird kasa DeviceID: %s", err.Error())
+		g.logger().Warn("weird kasa DeviceID", "err", err)
 		return
 	}
 	var ID uint64
@@ -95,37 +148,235 @@ func (g *generic) setID() {
 
 	// doesn't ever send -- Apple removed this from HomeKit ~2019
 	g.Info.Name.OnValueRemoteUpdate(func(newname string) {
-		log.Info.Printf("[%s] renamed to %s", g.Sysinfo.Alias, newname)
+		g.logger().Info("renamed from HomeKit", "name", newname)
 		// rename it on the device...
 	})
 }
 
+// addLED adds the optional status LED switch, g.A must exist first, called last so other service IDs don't move
+func (g *generic) addLED() {
+	if !g.b.conf.ledSwitch(g.Sysinfo.DeviceID, g.Sysinfo.Alias) {
+		return
+	}
+
+	g.LED = newLEDSvc()
+	g.LED.On.SetValue(g.Sysinfo.LEDOff == 0)
+	g.LED.On.OnValueRemoteUpdate(func(newstate bool) {
+		g.logger().Info("LED", "state", boolToState(newstate), "source", "homekit")
+		k, _ := g.b.newKasaIP(g.getIP())
+		if err := k.SetLEDOff(!newstate); err != nil {
+			g.logger().Warn("set LED failed", "err", err)
+			return
+		}
+	})
+	g.A.AddS(g.LED.S)
+}
+
+type ledSvc struct {
+	*service.S
+
+	On   *characteristic.On
+	Name *characteristic.Name
+}
+
+func newLEDSvc() *ledSvc {
+	svc := ledSvc{}
+	svc.S = service.New(service.TypeSwitch)
+
+	svc.On = characteristic.NewOn()
+	svc.AddC(svc.On.C)
+
+	svc.Name = characteristic.NewName()
+	svc.Name.SetValue("LED")
+	svc.AddC(svc.Name.C)
+
+	return &svc
+}
+
 func (g *generic) genericUpdate(k kasa.KasaDevice, newip net.IP) {
 	// if it was not responding, but is now...
 	if !g.StatusActive.Value() {
-		log.Info.Printf("[%s] responding again", g.Sysinfo.Alias)
+		g.logger().Info("responding again")
 		g.StatusActive.SetValue(true)
 		g.StatusFault.SetValue(characteristic.StatusFaultNoFault)
+		g.publish("reachable", "", "device", true)
+
+		if down := time.Since(g.lastUpdate); powerCycled(g.Sysinfo, k.GetSysinfo.Sysinfo, down) {
+			g.logger().Warn("appears to have lost power", "down", down.Round(time.Second).String())
+			g.outage = true
+		}
 	}
 
 	// netip.IP.Compare() exists but net.IP.Compare() does not
 	if g.ip.String() != newip.String() {
-		log.Info.Printf("updating ip address: [%s] -> [%s] (%s)", g.ip, newip, k.GetSysinfo.Sysinfo.Alias)
+		g.logger().Info("ip address changed", "new_ip", newip.String())
+		g.mu.Lock()
 		g.ip = newip
+		g.mu.Unlock()
+		g.publish("ip", "", "device", newip.String())
 	}
 
 	if g.Sysinfo.Alias != k.GetSysinfo.Sysinfo.Alias {
-		log.Info.Printf("renaming: [%s] -> [%s]", g.Sysinfo.Alias, k.GetSysinfo.Sysinfo.Alias)
+		g.logger().Info("renamed on the device", "name", k.GetSysinfo.Sysinfo.Alias)
+		g.mu.Lock()
 		g.Sysinfo.Alias = k.GetSysinfo.Sysinfo.Alias
+		g.mu.Unlock()
 		// HomeKit now ignores this
 		g.Info.Name.SetValue(k.GetSysinfo.Sysinfo.Alias)
 	}
 
 	g.RSSI.SetValue(int(k.GetSysinfo.Sysinfo.RSSI))
+	g.wifi.sample(k.GetSysinfo.Sysinfo.RSSI, false)
 	if k.GetSysinfo.Sysinfo.RSSI < -95 {
-		log.Info.Printf("[%s] weak WIFI signal: [%d]", g.Sysinfo.Alias, k.GetSysinfo.Sysinfo.RSSI)
+		g.logger().Warn("weak WIFI signal", "rssi", k.GetSysinfo.Sysinfo.RSSI)
+	}
+	if g.LED != nil && g.LED.On.Value() != (k.GetSysinfo.Sysinfo.LEDOff == 0) {
+		g.logger().Info("LED", "state", boolToState(k.GetSysinfo.Sysinfo.LEDOff == 0), "source", "device")
+		g.LED.On.SetValue(k.GetSysinfo.Sysinfo.LEDOff == 0)
 	}
+
+	// the startup cache has the versions from the last run
+	if g.Sysinfo.SWVersion != k.GetSysinfo.Sysinfo.SWVersion {
+		g.logger().Info("firmware changed", "from", g.Sysinfo.SWVersion, "to", k.GetSysinfo.Sysinfo.SWVersion, "hw", k.GetSysinfo.Sysinfo.HWVersion)
+		g.mu.Lock()
+		g.prevSWVer = g.Sysinfo.SWVersion
+		g.mu.Unlock()
+		g.Info.FirmwareRevision.SetValue(k.GetSysinfo.Sysinfo.SWVersion)
+	}
+
+	// keep the rest of sysinfo current, the name was handled above
+	g.mu.Lock()
+	g.Sysinfo = k.GetSysinfo.Sysinfo
 	g.lastUpdate = time.Now()
+	g.mu.Unlock()
+
+	if !g.applied {
+		g.applied = true
+		go g.applyConfig(k.GetSysinfo.Sysinfo, newip)
+	}
+}
+
+// sendRelay switches the device, or one outlet of a strip when child is set. Every device type's setRelay comes through
+// here, so this is where the switch is logged and published, with the source of the command: homekit, mqtt, group or restore.
+func (g *generic) sendRelay(child string, on bool, source string) error {
+	if child != "" {
+		g.logger().Info("set relay", "child", child, "state", boolToState(on), "source", source)
+	} else {
+		g.logger().Info("set relay", "state", boolToState(on), "source", source)
+	}
+
+	// HomeKit and MQTT call this while the Listener may be replacing sysinfo
+	s := g.sysinfo()
+	k, err := g.b.newKasaIP(g.getIP())
+	if err != nil {
+		return err
+	}
+
+	if child != "" {
+		if err := k.SetRelayStateChild(s.DeviceID+child, on); err != nil {
+			return err
+		}
+		g.publish("relay", child, source, on)
+		return nil
+	}
+
+	if err := k.SetRelayState(on); err != nil {
+		return err
+	}
+	if len(s.Children) == 0 {
+		g.publish("relay", "", source, on)
+	}
+	for _, c := range s.Children {
+		g.publish("relay", c.ID, source, on)
+	}
+	return nil
+}
+
+func (g *generic) outageRecovered() bool {
+	o := g.outage
+	g.outage = false
+	return o
+}
+
+// applyConfig pushes the settings from kasa.json to the device, once per run. It talks TCP to the device, so it runs
+// in its own goroutine rather than holding up the Listener.
+func (g *generic) applyConfig(s kasa.Sysinfo, ip net.IP) {
+	dc, ok := g.b.conf.device(s.DeviceID, s.Alias)
+	if !ok {
+		return
+	}
+	logger := slog.With("alias", s.Alias, "id", s.DeviceID, "ip", ip.String())
+
+	k, err := g.b.newKasaIP(ip)
+	if err != nil {
+		logger.Warn("unable to apply config", "err", err)
+		return
+	}
+
+	if dc.Alias != "" && dc.Alias != s.Alias {
+		logger.Info("setting alias on device", "name", dc.Alias)
+		if err := k.SetAlias(dc.Alias); err != nil {
+			logger.Warn("set alias failed", "err", err)
+		}
+	}
+
+	if dc.LEDOff != nil && *dc.LEDOff != (s.LEDOff > 0) {
+		logger.Info("setting LED from config", "state", boolToState(!*dc.LEDOff))
+		if err := k.SetLEDOff(*dc.LEDOff); err != nil {
+			logger.Warn("set LED failed", "err", err)
+		}
+	}
+
+	if dc.Cloud == "" {
+		return
+	}
+	// binding logs in to the TP-Link cloud, so only do it when the device isn't already set up
+	c, err := getCloudInfo(k)
+	if err != nil {
+		logger.Warn("unable to read cloud binding", "err", err)
+		return
+	}
+
+	switch {
+	case dc.Cloud == "bind" && (c.Bound == 0 || c.Username != dc.CloudUsername):
+		logger.Info("binding to TP-Link cloud", "username", dc.CloudUsername)
+		if err := k.EnableCloud(dc.CloudUsername, dc.CloudPassword); err != nil {
+			logger.Warn("cloud bind failed", "err", err)
+		}
+	case dc.Cloud == "unbind" && c.Bound != 0:
+		logger.Info("unbinding from TP-Link cloud")
+		if err := k.DisableCloud(); err != nil {
+			logger.Warn("cloud unbind failed", "err", err)
+		}
+	}
+}
+
+// cloudInfo is the part of cnCloud.get_info the bridge cares about
+type cloudInfo struct {
+	Username string `json:"username"`
+	Bound    uint   `json:"binded"`
+	ErrCode  int    `json:"err_code"`
+}
+
+// getCloudInfo uses TCP since go-kasa has no getter for the cloud binding
+func getCloudInfo(k *kasa.Device) (cloudInfo, error) {
+	var res struct {
+		CnCloud struct {
+			GetInfo cloudInfo `json:"get_info"`
+		} `json:"cnCloud"`
+	}
+
+	raw, err := k.SendRawCommand(`{"cnCloud":{"get_info":null}}`)
+	if err != nil {
+		return cloudInfo{}, err
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return cloudInfo{}, err
+	}
+	if res.CnCloud.GetInfo.ErrCode != 0 {
+		return cloudInfo{}, fmt.Errorf("get_info refused: %s", string(raw))
+	}
+	return res.CnCloud.GetInfo, nil
 }
 
 // kasa program mode to hap program mode
@@ -146,22 +397,34 @@ func kpm2hpm(kasaMode string) int {
 }
 
 func (g *generic) incomingEmeterData(e kasa.EmeterRealtime) {
-	log.Info.Printf("emeter update from non-emeter device: %s %+v", g.ip, e)
+	g.logger().Debug("emeter update from non-emeter device", "data", e)
 }
 
 func (g *generic) incomingDimmerData(e kasa.Dimmer) {
-	log.Info.Printf("dimmer update from non-dimmer device: %s %+v", g.ip, e)
+	g.logger().Debug("dimmer update from non-dimmer device", "data", e)
 }
 
 func (g *generic) incomingBrightnessData(e kasa.LightSensorBrightness) {
-	log.Info.Printf("brightness update from non-brightness device: %s %+v", g.ip, e)
+	g.logger().Debug("brightness update from non-brightness device", "data", e)
+}
+
+func (g *generic) incomingPIRData(e kasa.PIRSensorConfig) {
+	g.logger().Debug("PIR update from non-PIR device", "data", e)
 }
 
 func (g *generic) getIPstring() string {
-	return g.ip.String()
+	return g.getIP().String()
+}
+
+func (g *generic) previousFirmware() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.prevSWVer
 }
 
 func (g *generic) getAlias() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	return g.Sysinfo.Alias
 }
 
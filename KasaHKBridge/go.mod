@@ -5,6 +5,8 @@ go 1.25.0
 require (
 	github.com/brutella/hap v0.0.35
 	github.com/cloudkucooland/go-kasa v0.0.0-20260409231212-572c4a0bf3b9
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/go-chi/chi v1.5.5
 	github.com/urfave/cli/v2 v2.27.7
 	github.com/vishvananda/netlink v1.3.1
 )
@@ -12,7 +14,7 @@ require (
 require (
 	github.com/brutella/dnssd v1.2.14 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.7 // indirect
-	github.com/go-chi/chi v1.5.5 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/miekg/dns v1.1.72 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/tadglines/go-pkgs v0.0.0-20210623144937-b983b20f54f9 // indirect
@@ -0,0 +1,148 @@
+package kasahkbridge
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// group is a single HomeKit accessory for several devices or outlets, defined in kasa.json
+type group struct {
+	*accessory.A
+
+	b    *Bridge
+	name string
+	conf GroupConfig
+	On   *characteristic.On
+}
+
+func newGroup(b *Bridge, name string, gc GroupConfig) *group {
+	g := group{b: b, name: name, conf: gc}
+
+	// the ID has to stay the same between runs or HomeKit forgets the accessory
+	h := fnv.New64a()
+	h.Write([]byte("group:" + name))
+	id := h.Sum64()
+
+	info := accessory.Info{
+		Name:         name,
+		SerialNumber: fmt.Sprintf("%016X", id),
+		Manufacturer: "cloudkucooland",
+		Model:        "kasa-homekit group",
+		Firmware:     "0.0.5",
+	}
+
+	switch gc.Type {
+	case "lightbulb":
+		g.A = accessory.New(info, accessory.TypeLightbulb)
+		svc := service.NewLightbulb()
+		svc.Primary = true
+		g.AddS(svc.S)
+		g.On = svc.On
+	default:
+		g.A = accessory.New(info, accessory.TypeSwitch)
+		svc := service.NewSwitch()
+		svc.Primary = true
+		g.AddS(svc.S)
+		g.On = svc.On
+	}
+	g.A.Id = id
+
+	g.On.OnValueRemoteUpdate(func(newstate bool) {
+		g.set(newstate)
+	})
+
+	return &g
+}
+
+// newGroups builds the groups in name order so the accessory list is stable
+func newGroups(b *Bridge) []*group {
+	names := make([]string, 0, len(b.conf.Groups))
+	for name := range b.conf.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := make([]*group, 0, len(names))
+	for _, name := range names {
+		groups = append(groups, newGroup(b, name, b.conf.Groups[name]))
+	}
+	return groups
+}
+
+// set fans out to every member that has been discovered
+func (g *group) set(on bool) {
+	slog.Info("group set", "group", g.name, "state", boolToState(on))
+
+	for _, m := range g.conf.Members {
+		k, child := g.b.member(m)
+		if k == nil {
+			slog.Warn("group member not found", "group", g.name, "member", m)
+			continue
+		}
+		if err := k.setRelay(child, on, "group"); err != nil {
+			k.logger().Warn("group set failed", "group", g.name, "child", child, "err", err)
+		}
+	}
+
+	g.update()
+}
+
+// update derives the group state from the members
+func (g *group) update() {
+	anyOn, allOn, found := false, true, false
+
+	for _, m := range g.conf.Members {
+		k, child := g.b.member(m)
+		if k == nil {
+			continue
+		}
+		found = true
+		on := k.relay(child)
+		anyOn = anyOn || on
+		allOn = allOn && on
+	}
+	if !found {
+		return
+	}
+
+	state := anyOn
+	if g.conf.Mode == "all" {
+		state = allOn
+	}
+	if g.On.Value() != state {
+		slog.Info("group changed", "group", g.name, "state", boolToState(state))
+		g.On.SetValue(state)
+	}
+}
+
+// member finds a group member by DeviceID or alias, then by outlet alias or DeviceID+child ID
+func (b *Bridge) member(name string) (kasaDevice, string) {
+	if k := b.findDevice(name); k != nil {
+		return k, ""
+	}
+
+	b.kasasMu.RLock()
+	defer b.kasasMu.RUnlock()
+
+	for _, k := range b.kasas {
+		s := k.sysinfo()
+		for _, c := range s.Children {
+			if c.Alias == name || s.DeviceID+c.ID == name {
+				return k, c.ID
+			}
+		}
+	}
+	return nil, ""
+}
+
+func (b *Bridge) updateGroups() {
+	for _, g := range b.groups {
+		g.update()
+	}
+}
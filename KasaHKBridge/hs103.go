@@ -1,11 +1,11 @@
 package kasahkbridge
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -17,9 +17,9 @@ type HS103 struct {
 	Outlet *HS103Svc
 }
 
-func NewHS103(k kasa.KasaDevice, ip net.IP) *HS103 {
+func NewHS103(b *Bridge, k kasa.KasaDevice, ip net.IP) *HS103 {
 	acc := HS103{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeOutlet)
@@ -36,25 +36,23 @@ func NewHS103(k kasa.KasaDevice, ip net.IP) *HS103 {
 	acc.Outlet.ProgramMode.SetValue(pm)
 
 	acc.Outlet.On.OnValueRemoteUpdate(func(newstate bool) {
-		log.Info.Printf("[%s] %s", acc.Sysinfo.Alias, boolToState(newstate))
-		k, _ := newKasaIP(acc.ip)
-		if err := k.SetRelayState(newstate); err != nil {
-			log.Info.Println(err.Error())
-			return
+		if err := acc.b.commandRelay(&acc, "", newstate, "homekit"); err != nil {
+			acc.logger().Warn("set relay failed", "err", err)
 		}
-		acc.Outlet.OutletInUse.SetValue(newstate)
 	})
 
 	acc.Outlet.SetDuration.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting duration [%s] to [%d]", acc.Sysinfo.Alias, when)
-		if err := setCountdown(acc.ip, !acc.Outlet.On.Value(), when); err != nil {
-			log.Info.Println(err.Error())
+		acc.logger().Info("set countdown", "seconds", when)
+		if err := acc.b.setCountdown(acc.getIP(), !acc.Outlet.On.Value(), when); err != nil {
+			acc.logger().Warn("set countdown failed", "err", err)
 			return
 		}
 		acc.Outlet.ProgramMode.SetValue(characteristic.ProgramModeProgramScheduled)
 		acc.Outlet.RemainingDuration.SetValue(when)
 	})
 
+	acc.addLED()
+
 	return &acc
 }
 
@@ -100,26 +98,27 @@ func (h *HS103) update(k kasa.KasaDevice, newip net.IP) {
 	h.genericUpdate(k, newip)
 
 	if h.Outlet.On.Value() != (k.GetSysinfo.Sysinfo.RelayState > 0) {
-		log.Info.Printf("[%s] %s", k.GetSysinfo.Sysinfo.Alias, intToState(k.GetSysinfo.Sysinfo.RelayState))
+		h.logger().Info("relay", "state", intToState(k.GetSysinfo.Sysinfo.RelayState), "source", "device")
+		h.publish("relay", "", "device", k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Outlet.On.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Outlet.OutletInUse.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 	}
 
 	if h.Outlet.ProgramMode.Value() != kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode) {
-		log.Info.Printf("updating HomeKit: [%s] ProgramMode %s", k.GetSysinfo.Sysinfo.Alias, k.GetSysinfo.Sysinfo.ActiveMode)
+		h.logger().Debug("program mode", "mode", k.GetSysinfo.Sysinfo.ActiveMode)
 		h.Outlet.ProgramMode.SetValue(kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode))
 		if k.GetSysinfo.Sysinfo.ActiveMode == "none" {
-			d, _ := newKasaIP(h.ip)
+			d, _ := h.b.newKasaIP(h.ip)
 			_ = d.ClearCountdownRules()
 		}
 	}
 
 	if k.GetSysinfo.Sysinfo.ActiveMode == "count_down" {
-		d, _ := newKasaIP(h.ip)
+		d, _ := h.b.newKasaIP(h.ip)
 		rules, _ := d.GetCountdownRules()
 		for _, rule := range rules {
 			if rule.Enable > 0 {
-				log.Info.Printf("updating HomeKit: [%s] RemainingDuration %d", k.GetSysinfo.Sysinfo.Alias, rule.Remaining)
+				h.logger().Debug("countdown remaining", "seconds", rule.Remaining)
 				h.Outlet.RemainingDuration.SetValue(int(rule.Remaining))
 			}
 		}
@@ -127,3 +126,20 @@ func (h *HS103) update(k kasa.KasaDevice, newip net.IP) {
 		h.Outlet.RemainingDuration.SetValue(0)
 	}
 }
+
+func (h *HS103) relay(child string) bool {
+	return h.Outlet.On.Value()
+}
+
+func (h *HS103) setRelay(child string, on bool, source string) error {
+	if child != "" {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay("", on, source); err != nil {
+		return err
+	}
+	h.Outlet.On.SetValue(on)
+	h.Outlet.OutletInUse.SetValue(on)
+	return nil
+}
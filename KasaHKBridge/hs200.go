@@ -1,11 +1,11 @@
 package kasahkbridge
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -18,9 +18,9 @@ type HS200 struct {
 	Switch *HS200Svc
 }
 
-func NewHS200(k kasa.KasaDevice, ip net.IP) *HS200 {
+func NewHS200(b *Bridge, k kasa.KasaDevice, ip net.IP) *HS200 {
 	acc := HS200{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeSwitch)
@@ -36,24 +36,23 @@ func NewHS200(k kasa.KasaDevice, ip net.IP) *HS200 {
 	acc.Switch.ProgramMode.SetValue(pm)
 
 	acc.Switch.On.OnValueRemoteUpdate(func(newstate bool) {
-		log.Info.Printf("[%s] %s", acc.Sysinfo.Alias, boolToState(newstate))
-		k, _ := newKasaIP(acc.ip)
-		if err := k.SetRelayState(newstate); err != nil {
-			log.Info.Println(err.Error())
-			return
+		if err := acc.b.commandRelay(&acc, "", newstate, "homekit"); err != nil {
+			acc.logger().Warn("set relay failed", "err", err)
 		}
 	})
 
 	acc.Switch.SetDuration.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting duration [%s] to [%d]", acc.Sysinfo.Alias, when)
-		if err := setCountdown(acc.ip, !acc.Switch.On.Value(), when); err != nil {
-			log.Info.Println(err.Error())
+		acc.logger().Info("set countdown", "seconds", when)
+		if err := acc.b.setCountdown(acc.getIP(), !acc.Switch.On.Value(), when); err != nil {
+			acc.logger().Warn("set countdown failed", "err", err)
 			return
 		}
 		acc.Switch.ProgramMode.SetValue(characteristic.ProgramModeProgramScheduled)
 		acc.Switch.RemainingDuration.SetValue(when)
 	})
 
+	acc.addLED()
+
 	return &acc
 }
 
@@ -94,25 +93,26 @@ func (h *HS200) update(k kasa.KasaDevice, ip net.IP) {
 	h.genericUpdate(k, ip)
 
 	if h.Switch.On.Value() != (k.GetSysinfo.Sysinfo.RelayState > 0) {
-		log.Info.Printf("[%s] %s", k.GetSysinfo.Sysinfo.Alias, intToState(k.GetSysinfo.Sysinfo.RelayState))
+		h.logger().Info("relay", "state", intToState(k.GetSysinfo.Sysinfo.RelayState), "source", "device")
+		h.publish("relay", "", "device", k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Switch.On.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 	}
 
 	if h.Switch.ProgramMode.Value() != kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode) {
-		log.Info.Printf("updating HomeKit: [%s] ProgramMode %s", k.GetSysinfo.Sysinfo.Alias, k.GetSysinfo.Sysinfo.ActiveMode)
+		h.logger().Debug("program mode", "mode", k.GetSysinfo.Sysinfo.ActiveMode)
 		h.Switch.ProgramMode.SetValue(kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode))
 		if k.GetSysinfo.Sysinfo.ActiveMode == "none" {
-			d, _ := newKasaIP(h.ip)
+			d, _ := h.b.newKasaIP(h.ip)
 			_ = d.ClearCountdownRules()
 		}
 	}
 
 	if k.GetSysinfo.Sysinfo.ActiveMode == "count_down" {
-		d, _ := newKasaIP(h.ip)
+		d, _ := h.b.newKasaIP(h.ip)
 		rules, _ := d.GetCountdownRules()
 		for _, rule := range rules {
 			if rule.Enable > 0 {
-				log.Info.Printf("updating HomeKit: [%s] RemainingDuration %d", k.GetSysinfo.Sysinfo.Alias, rule.Remaining)
+				h.logger().Debug("countdown remaining", "seconds", rule.Remaining)
 				h.Switch.RemainingDuration.SetValue(int(rule.Remaining))
 			}
 		}
@@ -120,3 +120,19 @@ func (h *HS200) update(k kasa.KasaDevice, ip net.IP) {
 		h.Switch.RemainingDuration.SetValue(0)
 	}
 }
+
+func (h *HS200) relay(child string) bool {
+	return h.Switch.On.Value()
+}
+
+func (h *HS200) setRelay(child string, on bool, source string) error {
+	if child != "" {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay("", on, source); err != nil {
+		return err
+	}
+	h.Switch.On.SetValue(on)
+	return nil
+}
@@ -1,11 +1,11 @@
 package kasahkbridge
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -17,15 +17,15 @@ type HS220 struct {
 	Lightbulb *HS220Svc
 }
 
-func NewHS220(k kasa.KasaDevice, ip net.IP) *HS220 {
+func NewHS220(b *Bridge, k kasa.KasaDevice, ip net.IP) *HS220 {
 	acc := HS220{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeLightbulb)
 	acc.setID()
 
-	acc.Lightbulb = NewHS220Svc(ip)
+	acc.Lightbulb = NewHS220Svc()
 	acc.AddS(acc.Lightbulb.S)
 	acc.Lightbulb.AddC(acc.generic.StatusActive.C)
 	acc.Lightbulb.AddC(acc.generic.StatusFault.C)
@@ -36,11 +36,8 @@ func NewHS220(k kasa.KasaDevice, ip net.IP) *HS220 {
 	acc.Lightbulb.ProgramMode.SetValue(pm)
 
 	acc.Lightbulb.On.OnValueRemoteUpdate(func(newstate bool) {
-		log.Info.Printf("[%s] %s", acc.Sysinfo.Alias, boolToState(newstate))
-		k, _ := newKasaIP(acc.ip)
-		if err := k.SetRelayState(newstate); err != nil {
-			log.Info.Println(err.Error())
-			return
+		if err := acc.b.commandRelay(&acc, "", newstate, "homekit"); err != nil {
+			acc.logger().Warn("set relay failed", "err", err)
 		}
 	})
 
@@ -48,18 +45,15 @@ func NewHS220(k kasa.KasaDevice, ip net.IP) *HS220 {
 		if newstate == 0 {
 			return
 		}
-		log.Info.Printf("[%s] %d%%", acc.Sysinfo.Alias, newstate)
-		k, _ := newKasaIP(acc.ip)
-		if err := k.SetBrightness(newstate); err != nil {
-			log.Info.Println(err.Error())
-			return
+		if err := acc.setBrightness(newstate, "homekit"); err != nil {
+			acc.logger().Warn("set brightness failed", "err", err)
 		}
 	})
 
 	acc.Lightbulb.SetDuration.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting duration [%s] to [%d]", acc.Sysinfo.Alias, when)
-		if err := setCountdown(acc.ip, !acc.Lightbulb.On.Value(), when); err != nil {
-			log.Info.Println(err.Error())
+		acc.logger().Info("set countdown", "seconds", when)
+		if err := acc.b.setCountdown(acc.getIP(), !acc.Lightbulb.On.Value(), when); err != nil {
+			acc.logger().Warn("set countdown failed", "err", err)
 			return
 		}
 		acc.Lightbulb.ProgramMode.SetValue(characteristic.ProgramModeProgramScheduled)
@@ -67,41 +61,45 @@ func NewHS220(k kasa.KasaDevice, ip net.IP) *HS220 {
 	})
 
 	acc.Lightbulb.FadeOnTime.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting fade on time [%s] to [%d]", acc.Sysinfo.Alias, when)
-		kd, _ := newKasaIP(acc.ip)
+		acc.logger().Info("set fade on time", "value", when)
+		kd, _ := acc.b.newKasaIP(acc.getIP())
 		if err := kd.SetFadeOnTime(when); err != nil {
-			log.Info.Println(err.Error())
+			acc.logger().Warn("set fade on time failed", "err", err)
 			return
 		}
 	})
 
 	acc.Lightbulb.FadeOffTime.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting fade off time [%s] to [%d]", acc.Sysinfo.Alias, when)
-		kd, _ := newKasaIP(acc.ip)
+		acc.logger().Info("set fade off time", "value", when)
+		kd, _ := acc.b.newKasaIP(acc.getIP())
 		if err := kd.SetFadeOffTime(when); err != nil {
-			log.Info.Println(err.Error())
+			acc.logger().Warn("set fade off time failed", "err", err)
 			return
 		}
 	})
 
 	acc.Lightbulb.GentleOnTime.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting gentle on time [%s] to [%d]", acc.Sysinfo.Alias, when)
-		kd, _ := newKasaIP(acc.ip)
+		acc.logger().Info("set gentle on time", "value", when)
+		kd, _ := acc.b.newKasaIP(acc.getIP())
 		if err := kd.SetGentleOnTime(when); err != nil {
-			log.Info.Println(err.Error())
+			acc.logger().Warn("set gentle on time failed", "err", err)
 			return
 		}
 	})
 
 	acc.Lightbulb.GentleOffTime.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting gentle off time [%s] to [%d]", acc.Sysinfo.Alias, when)
-		kd, _ := newKasaIP(acc.ip)
+		acc.logger().Info("set gentle off time", "value", when)
+		kd, _ := acc.b.newKasaIP(acc.getIP())
 		if err := kd.SetGentleOffTime(when); err != nil {
-			log.Info.Println(err.Error())
+			acc.logger().Warn("set gentle off time failed", "err", err)
 			return
 		}
 	})
 
+	acc.addLED()
+
+	acc.b.getDimmerParametersUDP(ip)
+
 	return &acc
 }
 
@@ -123,7 +121,7 @@ type HS220Svc struct {
 	MinThreshold  *minThreshold
 }
 
-func NewHS220Svc(ip net.IP) *HS220Svc {
+func NewHS220Svc() *HS220Svc {
 	svc := HS220Svc{}
 	svc.S = service.New(service.TypeLightbulb)
 
@@ -164,26 +162,27 @@ func NewHS220Svc(ip net.IP) *HS220Svc {
 
 	svc.S.Primary = true
 
-	getDimmerParametersUDP(ip)
 	return &svc
 }
 
 func (h *HS220) update(k kasa.KasaDevice, ip net.IP) {
 	h.genericUpdate(k, ip)
-	d, _ := newKasaIP(ip)
+	d, _ := h.b.newKasaIP(ip)
 
 	if h.Lightbulb.On.Value() != (k.GetSysinfo.Sysinfo.RelayState > 0) {
-		log.Info.Printf("[%s] %s", k.GetSysinfo.Sysinfo.Alias, intToState(k.GetSysinfo.Sysinfo.RelayState))
+		h.logger().Info("relay", "state", intToState(k.GetSysinfo.Sysinfo.RelayState), "source", "device")
+		h.publish("relay", "", "device", k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Lightbulb.On.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 	}
 
 	if h.Lightbulb.Brightness.Value() != int(k.GetSysinfo.Sysinfo.Brightness) {
-		log.Info.Printf("[%s] %d%%", k.GetSysinfo.Sysinfo.Alias, int(k.GetSysinfo.Sysinfo.Brightness))
+		h.logger().Info("brightness", "level", int(k.GetSysinfo.Sysinfo.Brightness), "source", "device")
+		h.publish("brightness", "", "device", int(k.GetSysinfo.Sysinfo.Brightness))
 		h.Lightbulb.Brightness.SetValue(int(k.GetSysinfo.Sysinfo.Brightness))
 	}
 
 	if h.Lightbulb.ProgramMode.Value() != kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode) {
-		log.Info.Printf("updating HomeKit: [%s] ProgramMode %s", k.GetSysinfo.Sysinfo.Alias, k.GetSysinfo.Sysinfo.ActiveMode)
+		h.logger().Debug("program mode", "mode", k.GetSysinfo.Sysinfo.ActiveMode)
 		h.Lightbulb.ProgramMode.SetValue(kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode))
 		if k.GetSysinfo.Sysinfo.ActiveMode == "none" {
 			_ = d.ClearCountdownRules()
@@ -194,7 +193,7 @@ func (h *HS220) update(k kasa.KasaDevice, ip net.IP) {
 		rules, _ := d.GetCountdownRules()
 		for _, rule := range rules {
 			if rule.Enable > 0 {
-				log.Info.Printf("updating HomeKit: [%s] RemainingDuration %d", k.GetSysinfo.Sysinfo.Alias, rule.Remaining)
+				h.logger().Debug("countdown remaining", "seconds", rule.Remaining)
 				h.Lightbulb.RemainingDuration.SetValue(int(rule.Remaining))
 			}
 		}
@@ -203,32 +202,64 @@ func (h *HS220) update(k kasa.KasaDevice, ip net.IP) {
 	}
 
 	// almost certainly pointless since these so rarely change, maybe run once a day?
-	getDimmerParametersUDP(ip)
+	h.b.getDimmerParametersUDP(ip)
 }
 
 func (h *HS220) incomingDimmerData(dim kasa.Dimmer) {
 	if h.Lightbulb.MinThreshold.Value() != int(dim.Parameters.MinThreshold) {
-		log.Info.Printf("updating MinThreshold: [%d] => [%d]", h.Lightbulb.MinThreshold.Value(), dim.Parameters.MinThreshold)
+		h.logger().Debug("dimmer parameter", "min_threshold", dim.Parameters.MinThreshold)
 		h.Lightbulb.MinThreshold.SetValue(int(dim.Parameters.MinThreshold))
 	}
 	if h.Lightbulb.FadeOnTime.Value() != int(dim.Parameters.FadeOnTime) {
-		log.Info.Printf("updating FadeOnTime: [%d] => [%d]", h.Lightbulb.FadeOnTime.Value(), dim.Parameters.FadeOnTime)
+		h.logger().Debug("dimmer parameter", "fade_on_time", dim.Parameters.FadeOnTime)
 		h.Lightbulb.FadeOnTime.SetValue(int(dim.Parameters.FadeOnTime))
 	}
 	if h.Lightbulb.FadeOffTime.Value() != int(dim.Parameters.FadeOffTime) {
-		log.Info.Printf("updating FadeOffTime: [%d] => [%d]", h.Lightbulb.FadeOffTime.Value(), dim.Parameters.FadeOffTime)
+		h.logger().Debug("dimmer parameter", "fade_off_time", dim.Parameters.FadeOffTime)
 		h.Lightbulb.FadeOffTime.SetValue(int(dim.Parameters.FadeOffTime))
 	}
 	if h.Lightbulb.GentleOnTime.Value() != int(dim.Parameters.GentleOnTime) {
-		log.Info.Printf("updating GentleOnTime: [%d] => [%d]", h.Lightbulb.GentleOnTime.Value(), dim.Parameters.GentleOnTime)
+		h.logger().Debug("dimmer parameter", "gentle_on_time", dim.Parameters.GentleOnTime)
 		h.Lightbulb.GentleOnTime.SetValue(int(dim.Parameters.GentleOnTime))
 	}
 	if h.Lightbulb.GentleOffTime.Value() != int(dim.Parameters.GentleOffTime) {
-		log.Info.Printf("updating GentleOffTime: [%d] => [%d]", h.Lightbulb.GentleOffTime.Value(), dim.Parameters.GentleOffTime)
+		h.logger().Debug("dimmer parameter", "gentle_off_time", dim.Parameters.GentleOffTime)
 		h.Lightbulb.GentleOffTime.SetValue(int(dim.Parameters.GentleOffTime))
 	}
 	if h.Lightbulb.RampRate.Value() != int(dim.Parameters.RampRate) {
-		log.Info.Printf("updating RampRate: [%d] => [%d]", h.Lightbulb.RampRate.Value(), dim.Parameters.RampRate)
+		h.logger().Debug("dimmer parameter", "ramp_rate", dim.Parameters.RampRate)
 		h.Lightbulb.RampRate.SetValue(int(dim.Parameters.RampRate))
 	}
 }
+
+func (h *HS220) relay(child string) bool {
+	return h.Lightbulb.On.Value()
+}
+
+func (h *HS220) setRelay(child string, on bool, source string) error {
+	if child != "" {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay("", on, source); err != nil {
+		return err
+	}
+	h.Lightbulb.On.SetValue(on)
+	return nil
+}
+
+func (h *HS220) brightness() int {
+	return h.Lightbulb.Brightness.Value()
+}
+
+// setBrightness is the command path for HomeKit and MQTT, 1-100
+func (h *HS220) setBrightness(level int, source string) error {
+	h.logger().Info("set brightness", "level", level, "source", source)
+	k, _ := h.b.newKasaIP(h.getIP())
+	if err := k.SetBrightness(level); err != nil {
+		return err
+	}
+	h.Lightbulb.Brightness.SetValue(level)
+	h.publish("brightness", "", source, level)
+	return nil
+}
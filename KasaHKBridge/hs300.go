@@ -7,7 +7,6 @@ import (
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -19,9 +18,9 @@ type HS300 struct {
 	OutletMap map[string]*hs300outletSvc
 }
 
-func NewHS300(k kasa.KasaDevice, ip net.IP) *HS300 {
+func NewHS300(b *Bridge, k kasa.KasaDevice, ip net.IP) *HS300 {
 	acc := HS300{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeOutlet)
@@ -40,30 +39,28 @@ func NewHS300(k kasa.KasaDevice, ip net.IP) *HS300 {
 		id := fmt.Sprintf("%s%s", acc.Sysinfo.DeviceID[32:], acc.Sysinfo.Children[idx].ID)
 		o.AccIdentifier.SetValue(id)
 		if dx, err := strconv.ParseInt(id, 16, 64); err != nil {
-			log.Info.Println(err.Error())
+			acc.logger().Warn("weird outlet ID", "child", acc.Sysinfo.Children[idx].ID, "err", err)
 		} else {
 			o.ID.SetValue(int(dx))
 			o.Id = uint64(dx)
 		}
 
+		// the handlers run on HomeKit's goroutines, so they keep the IDs rather than reading Sysinfo
+		child := acc.Sysinfo.Children[idx].ID
+		full := acc.Sysinfo.DeviceID + child
+
 		o.On.OnValueRemoteUpdate(func(newstate bool) {
-			log.Info.Printf("[%s][%d] %s", acc.Sysinfo.Alias, idx, boolToState(newstate))
-			full := fmt.Sprintf("%s%s", acc.Sysinfo.DeviceID, acc.Sysinfo.Children[idx].ID)
-			k, _ := newKasaIP(acc.ip)
-			if err := k.SetRelayStateChild(full, newstate); err != nil {
-				log.Info.Println(err.Error())
-				return
+			if err := acc.b.commandRelay(&acc, child, newstate, "homekit"); err != nil {
+				acc.logger().Warn("set relay failed", "child", child, "err", err)
 			}
-			o.OutletInUse.SetValue(newstate)
 		})
 
         // HomeKit removed this, leaving our part in place
 		o.Name.OnValueRemoteUpdate(func(newname string) {
-			log.Info.Printf("[%s][%d] new name %s", acc.Sysinfo.Alias, idx, newname)
-			full := fmt.Sprintf("%s%s", acc.Sysinfo.DeviceID, acc.Sysinfo.Children[idx].ID)
-			k, _ := newKasaIP(acc.ip)
+			acc.logger().Info("renamed from HomeKit", "child", child, "name", newname)
+			k, _ := acc.b.newKasaIP(acc.getIP())
 			if err := k.SetChildAlias(full, newname); err != nil {
-				log.Info.Println(err.Error())
+				acc.logger().Warn("rename failed", "child", child, "err", err)
 				return
 			}
 		})
@@ -72,6 +69,8 @@ func NewHS300(k kasa.KasaDevice, ip net.IP) *HS300 {
 		acc.OutletMap[acc.Sysinfo.Children[idx].ID] = o
 	}
 
+	acc.addLED()
+
 	return &acc
 }
 
@@ -141,27 +140,54 @@ func (h *HS300) update(k kasa.KasaDevice, ip net.IP) {
 	for id, outlet := range h.OutletMap {
 		data, err := getChildFromID(k, id)
 		if err != nil {
-			log.Info.Println(err.Error())
+			h.logger().Warn("outlet missing from sysinfo", "child", id, "err", err)
 			continue
 		}
 
 		if outlet.On.Value() != (data.RelayState > 0) {
-			log.Info.Printf("[%s][%s] %s", k.GetSysinfo.Sysinfo.Alias, id, intToState(data.RelayState))
+			h.logger().Info("relay", "child", id, "state", intToState(data.RelayState), "source", "device")
+			h.publish("relay", id, "device", data.RelayState > 0)
 			outlet.On.SetValue(data.RelayState > 0)
 			outlet.OutletInUse.SetValue(data.RelayState > 0)
 		}
 
         // HomeKit ignores name updates
 		if outlet.Name.Value() != data.Alias {
-			log.Info.Printf("updating HomeKit: [%s][%s] name %s", k.GetSysinfo.Sysinfo.Alias, id, data.Alias)
+			h.logger().Info("outlet renamed on the device", "child", id, "name", data.Alias)
 			outlet.Name.SetValue(data.Alias)
 		}
 
 		// request emeter data for each outlet
-		if err := getEmeterChildUDP(h.ip, h.Sysinfo.DeviceID, id); err != nil {
-			log.Info.Println(err.Error())
+		_ = h.b.getEmeterChildUDP(h.ip, h.Sysinfo.DeviceID, id)
+	}
+}
+
+// relay with no child is on if any outlet is on
+func (h *HS300) relay(child string) bool {
+	for id, o := range h.OutletMap {
+		if (child == "" || id == child) && o.On.Value() {
+			return true
+		}
+	}
+	return false
+}
+
+// setRelay with no child switches every outlet
+func (h *HS300) setRelay(child string, on bool, source string) error {
+	if _, ok := h.OutletMap[child]; child != "" && !ok {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay(child, on, source); err != nil {
+		return err
+	}
+	for id, o := range h.OutletMap {
+		if child == "" || id == child {
+			o.On.SetValue(on)
+			o.OutletInUse.SetValue(on)
 		}
 	}
+	return nil
 }
 
 func getChildFromID(k kasa.KasaDevice, id string) (*kasa.Child, error) {
@@ -184,13 +210,13 @@ func (h *HS300) getOutletFromSlot(slot uint) (*hs300outletSvc, error) {
 
 func (h *HS300) incomingEmeterData(e kasa.EmeterRealtime) {
 	if int(e.Slot) >= len(h.OutletMap) {
-		log.Info.Printf("slot out of bounds: %d", e.Slot)
+		h.logger().Warn("emeter slot out of bounds", "slot", e.Slot)
 		return
 	}
 
 	child, err := h.getOutletFromSlot(e.Slot)
 	if err != nil {
-		log.Info.Println(err.Error())
+		h.logger().Warn("no outlet for emeter slot", "slot", e.Slot, "err", err)
 		return
 	}
 
@@ -198,41 +224,44 @@ func (h *HS300) incomingEmeterData(e kasa.EmeterRealtime) {
 	child.Volt.SetValue(v)
 	switch {
 	case v > 130:
-		log.Info.Printf("[%s][%s] dangerously high voltage: %dV", h.Sysinfo.Alias, child.Name.Value(), v)
+		h.logger().Error("dangerously high voltage, turning off", "child", h.Sysinfo.Children[e.Slot].ID, "volts", v)
 		child.StatusFault.SetValue(characteristic.StatusFaultGeneralFault)
 
 		full := fmt.Sprintf("%s%s", h.Sysinfo.DeviceID, h.Sysinfo.Children[e.Slot].ID)
-		k, _ := newKasaIP(h.ip)
+		k, _ := h.b.newKasaIP(h.ip)
 		if err := k.SetRelayStateChild(full, false); err != nil {
-			log.Info.Println(err.Error())
+			h.logger().Warn("unable to turn off", "child", h.Sysinfo.Children[e.Slot].ID, "err", err)
 			return
 		}
 		child.On.SetValue(false)
 		child.OutletInUse.SetValue(false)
+		h.publish("relay", h.Sysinfo.Children[e.Slot].ID, "cutoff", false)
 	case v > 127:
-		log.Info.Printf("[%s][%s] high voltage: %dV", h.Sysinfo.Alias, child.Name.Value(), v)
+		h.logger().Warn("high voltage", "child", h.Sysinfo.Children[e.Slot].ID, "volts", v)
 		if child.StatusFault.Value() == characteristic.StatusFaultGeneralFault {
 			child.StatusFault.SetValue(characteristic.StatusFaultNoFault)
 		}
 	case v < 114:
-		log.Info.Printf("[%s][%s] low voltage: %dV", h.Sysinfo.Alias, child.Name.Value(), v)
+		h.logger().Warn("low voltage", "child", h.Sysinfo.Children[e.Slot].ID, "volts", v)
 		if child.StatusFault.Value() == characteristic.StatusFaultGeneralFault {
 			child.StatusFault.SetValue(characteristic.StatusFaultNoFault)
 		}
 	case v < 110:
-		log.Info.Printf("[%s][%s] dangerously low voltage: %dV", h.Sysinfo.Alias, child.Name.Value(), v)
+		h.logger().Error("dangerously low voltage, turning off", "child", h.Sysinfo.Children[e.Slot].ID, "volts", v)
 		child.StatusFault.SetValue(characteristic.StatusFaultGeneralFault)
 
 		full := fmt.Sprintf("%s%s", h.Sysinfo.DeviceID, h.Sysinfo.Children[e.Slot].ID)
-		k, _ := newKasaIP(h.ip)
+		k, _ := h.b.newKasaIP(h.ip)
 		if err := k.SetRelayStateChild(full, false); err != nil {
-			log.Info.Println(err.Error())
+			h.logger().Warn("unable to turn off", "child", h.Sysinfo.Children[e.Slot].ID, "err", err)
 			return
 		}
 		child.On.SetValue(false)
 		child.OutletInUse.SetValue(false)
+		h.publish("relay", h.Sysinfo.Children[e.Slot].ID, "cutoff", false)
 	}
 
 	child.Watt.SetValue(int(e.PowerMW / 1000))
 	child.Amp.SetValue(int(e.CurrentMA))
+	h.publishEmeter(h.Sysinfo.Children[e.Slot].ID, e)
 }
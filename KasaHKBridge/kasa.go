@@ -5,60 +5,68 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/brutella/hap/accessory"
-	"github.com/brutella/hap/log"
 
 	"github.com/cloudkucooland/go-kasa"
 )
 
-// globals are OK since there will only ever be one bridge
-var kasas map[string]kasaDevice
-var kasasMu sync.RWMutex
 var bufsize int = 2048
-var packetconn *net.UDPConn
-var broadcasts []net.IP
-
-var pollInterval time.Duration = 30 * time.Second
 
 // avoid allocations in the main loops -- could pre-scramble these
 var relaySuccess = []byte(`{"system":{"set_relay_state":{"err_code":0}}}`)
 var emeterSuccess = []byte(`{"smartlife.iot.dimmer":{"set_brightness":{"err_code":0}}}`)
+var ledSuccess = []byte(`{"system":{"set_led_off":{"err_code":0}}}`)
+var aliasSuccess = []byte(`{"system":{"set_dev_alias":{"err_code":0}}}`)
+var bindSuccess = []byte(`{"cnCloud":{"bind":{"err_code":0}}}`)
+var unbindSuccess = []byte(`{"cnCloud":{"unbind":{"err_code":0}}}`)
 var sysinfoPreamble = []byte(`"get_sysinfo"`)
 var emeterPreamble = []byte(`{"emeter":{"get_realtime":{`)
 var dimmerPreamble = []byte(`{"smartlife.iot.dimmer":{"get_dimmer_parameters":{`)
 var brightnessPreamble = []byte(`{"smartlife.iot.LAS":{"get_current_brt":{"value"`)
+var pirPreamble = []byte(`{"smartlife.iot.PIR":{"get_config":{`)
 
 const CHANGE_SLEEP_DURATION = (100 * time.Millisecond)
 
 var discoverCmd = kasa.Scramble(kasa.CmdGetSysinfo)
 
 type kasaDevice interface {
-	getA() *accessory.A
+	// only on the Listener goroutine, these change the device
 	update(kasa.KasaDevice, net.IP)
 	incomingEmeterData(kasa.EmeterRealtime)
 	incomingDimmerData(kasa.Dimmer)
 	incomingBrightnessData(kasa.LightSensorBrightness)
+	incomingPIRData(kasa.PIRSensorConfig)
+	outageRecovered() bool // true once after the device comes back from a power cut
+
+	// from any goroutine, these read through the device lock or only touch characteristics, which have their own
+	getA() *accessory.A
 	getLastUpdate() time.Time
 	unreachable()
+	reachable() bool
+	logger() *slog.Logger // tagged with the device
 	getIPstring() string
 	getAlias() string
 	sysinfo() kasa.Sysinfo
+	wifiReport(bool) WifiReport
+	previousFirmware() string
+	relay(child string) bool                             // child is "" for the device itself, or every outlet of a strip
+	setRelay(child string, on bool, source string) error // the command path for HomeKit, MQTT, groups and after_outage
 }
 
-type factoryFunc func(kasa.KasaDevice, net.IP) kasaDevice
+type factoryFunc func(*Bridge, kasa.KasaDevice, net.IP) kasaDevice
 
 // wrapper since New* returns a poninter but a pointer to an interface is useless
-func wrap[T kasaDevice](fn func(kasa.KasaDevice, net.IP) T) factoryFunc {
-	return func(k kasa.KasaDevice, ip net.IP) kasaDevice {
-		return fn(k, ip)
+func wrap[T kasaDevice](fn func(*Bridge, kasa.KasaDevice, net.IP) T) factoryFunc {
+	return func(b *Bridge, k kasa.KasaDevice, ip net.IP) kasaDevice {
+		return fn(b, k, ip)
 	}
 }
 
-var deviceFactories = map[string]func(kasa.KasaDevice, net.IP) kasaDevice{
+var deviceFactories = map[string]factoryFunc{
 	"HS103(US)":  wrap(NewHS103),
 	"HS200(US)":  wrap(NewHS200),
 	"HS210(US)":  wrap(NewHS200),
@@ -69,113 +77,137 @@ var deviceFactories = map[string]func(kasa.KasaDevice, net.IP) kasaDevice{
 	"KS200M(US)": wrap(NewKS200m),
 }
 
-// Listener is the go process that listens for UDP responses from the Kasa devices
-func Listener(ctx context.Context, refresh chan bool) {
+// Listener is the go process that handles the UDP responses from the Kasa devices
+func (b *Bridge) Listener(ctx context.Context, refresh chan bool) {
+	defer close(b.listenerDone)
+
 	var err error
-	packetconn, err = net.ListenUDP("udp", &net.UDPAddr{IP: nil, Port: 0})
+	b.packetconn, err = net.ListenUDP("udp", &net.UDPAddr{IP: nil, Port: 0})
 	if err != nil {
-		log.Info.Println(err.Error())
+		slog.Error("unable to open the UDP socket", "err", err)
 		return
 	}
-	defer packetconn.Close()
+	defer b.packetconn.Close()
+	defer b.closeInterfaces()
 
-	buffer := make([]byte, bufsize)
+	go b.readPackets(b.packetconn)
+	close(b.ready)
 
 	for {
+		var p packet
 		select {
 		case <-ctx.Done():
-			log.Info.Println("shutting down listener")
-			return
-		default:
-		}
-
-		_ = packetconn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-		n, addr, err := packetconn.ReadFromUDP(buffer)
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Timeout() {
-				continue
-			}
-			log.Info.Println(err.Error())
+			slog.Info("shutting down listener")
 			return
+		case p = <-b.packets:
 		}
 
-		d := kasa.Unscramble(buffer[:n])
+		d, addr := p.data, p.addr
 
 		// ignore success messages
-		if bytes.Equal(d, relaySuccess) || bytes.Equal(d, emeterSuccess) {
+		if bytes.Equal(d, relaySuccess) || bytes.Equal(d, emeterSuccess) ||
+			bytes.Equal(d, ledSuccess) || bytes.Equal(d, aliasSuccess) ||
+			bytes.Equal(d, bindSuccess) || bytes.Equal(d, unbindSuccess) {
 			continue
 		}
 
 		if !(bytes.Contains(d, sysinfoPreamble) ||
 			bytes.HasPrefix(d, emeterPreamble) ||
 			bytes.HasPrefix(d, dimmerPreamble) ||
-			bytes.HasPrefix(d, brightnessPreamble)) {
-			log.Info.Printf("unknown message from %s: %s", addr.IP.String(), string(d))
+			bytes.HasPrefix(d, brightnessPreamble) ||
+			bytes.HasPrefix(d, pirPreamble)) {
+			slog.Warn("unknown message", "ip", addr.IP.String(), "message", string(d))
+			continue
+		}
+
+		// go-kasa's KasaDevice has no place for the PIR config
+		if bytes.HasPrefix(d, pirPreamble) {
+			var pir struct {
+				PIR kasa.PIRSensor `json:"smartlife.iot.PIR"`
+			}
+			if err = json.Unmarshal(d, &pir); err != nil {
+				slog.Warn("unmarshal failed", "ip", addr.IP.String(), "err", err)
+				continue
+			}
+			b.updatePIR(pir.PIR.GetConfig, addr.IP.String())
 			continue
 		}
 
 		var kd kasa.KasaDevice
 		if err = json.Unmarshal(d, &kd); err != nil {
-			log.Info.Printf("unmarshal failed: %s", err.Error())
+			slog.Warn("unmarshal failed", "ip", addr.IP.String(), "err", err)
 			continue
 		}
 
 		if err := kd.GetSysinfo.Sysinfo.OK(); err != nil {
-			log.Info.Println(err)
+			slog.Warn("device returned an error", "ip", addr.IP.String(), "err", err)
 			continue
 		}
 
 		if bytes.HasPrefix(d, emeterPreamble) {
-			updateEmeter(kd.Emeter.Realtime, addr.IP.String())
+			b.updateEmeter(kd.Emeter.Realtime, addr.IP.String())
 			continue
 		}
 
 		if bytes.HasPrefix(d, dimmerPreamble) {
-			updateDimmer(kd.Dimmer, addr.IP.String())
+			b.updateDimmer(kd.Dimmer, addr.IP.String())
 			continue
 		}
 
 		if bytes.HasPrefix(d, brightnessPreamble) {
-			updateBrightness(kd.LightSensor.GetBrightness, addr.IP.String())
+			b.updateBrightness(kd.LightSensor.GetBrightness, addr.IP.String())
 			continue
 		}
 
-		kasasMu.RLock()
-		k, ok := kasas[kd.GetSysinfo.Sysinfo.DeviceID]
-		kasasMu.RUnlock()
+		b.kasasMu.RLock()
+		k, ok := b.kasas[kd.GetSysinfo.Sysinfo.DeviceID]
+		b.kasasMu.RUnlock()
 
 		// potential for race, but exceedingly unlikely since this only hit during
 		// initialization except in VERY rare cases of a new device being brought online
 		if !ok {
 			if factory, kOk := deviceFactories[kd.GetSysinfo.Sysinfo.Model]; kOk {
-				kasasMu.Lock()
-				kasas[kd.GetSysinfo.Sysinfo.DeviceID] = factory(kd, addr.IP)
-				kasasMu.Unlock()
+				b.kasasMu.Lock()
+				b.kasas[kd.GetSysinfo.Sysinfo.DeviceID] = factory(b, kd, addr.IP)
+				b.kasasMu.Unlock()
 				refresh <- true // blocking is OK during initialization
 			} else {
-				log.Info.Printf("unknown device type (%s)", kd.GetSysinfo.Sysinfo.Model)
+				slog.Warn("unknown device type", "model", kd.GetSysinfo.Sysinfo.Model, "ip", addr.IP.String())
 			}
 		} else {
 			k.update(kd, addr.IP)
+			// on the Listener, so the device can't be updated under it, setRelay only sends UDP so it doesn't hold anything up
+			if k.outageRecovered() {
+				b.afterOutage(k)
+			}
+			b.updateGroups()
 		}
 	}
 }
 
-// Startup
-func Startup(ctx context.Context, refresh chan bool, path string) error {
-	kasas = make(map[string]kasaDevice)
+// Startup loads the cache, opens the discovery sockets and starts the poller, it waits for the Listener to be running
+func (b *Bridge) Startup(ctx context.Context, refresh chan bool, path string) error {
+	// the devices from the cache start sending as soon as they are built
+	select {
+	case <-b.ready:
+	case <-b.listenerDone:
+		return fmt.Errorf("listener failed to start")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
-	kasa.SetLogger(log.Info)
-	loadCache(path)
+	kasa.SetLogger(slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn))
+	b.loadCache(path)
+	b.loadRelayState(path)
 
-	if err := SetBroadcasts(); err != nil {
+	if err := b.SetBroadcasts(); err != nil {
 		return err
 	}
 
-	log.Info.Println("Starting initial discovery (3 seconds)")
+	slog.Info("starting initial discovery (3 seconds)")
 
 	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	discover()
+	b.discover()
 
 FIRST:
 	for {
@@ -187,183 +219,199 @@ FIRST:
 		}
 	}
 
-	log.Info.Printf("Initial discovery complete, found %d devices", len(kasas))
+	b.kasasMu.RLock()
+	slog.Info("initial discovery complete", "devices", len(b.kasas))
+	b.kasasMu.RUnlock()
 	cancel()
 
 	// start the routine poller
-	go poller(ctx)
+	go b.poller(ctx)
 
 	return nil
 }
 
 // Devices returns the accessories ready for HAP to start a hap.Server
-func Devices() []*accessory.A {
+func (b *Bridge) Devices() []*accessory.A {
 	var a []*accessory.A
 
-	kasasMu.RLock()
-	for _, k := range kasas {
+	b.kasasMu.RLock()
+	for _, k := range b.kasas {
 		a = append(a, k.getA())
 	}
-	kasasMu.RUnlock()
+	b.kasasMu.RUnlock()
 
-	return a
-}
+	for _, g := range b.groups {
+		a = append(a, g.A)
+	}
 
-func SetBroadcasts() error {
-	var err error
-	log.Debug.Printf("updating broadcasts")
-	broadcasts, err = kasa.BroadcastAddresses()
-	return err
+	return a
 }
 
-func poller(ctx context.Context) {
-	t := time.NewTicker(pollInterval)
+func (b *Bridge) poller(ctx context.Context) {
+	t := time.NewTicker(b.pollInterval)
 	defer t.Stop()
 
 	for {
-		discover()
+		b.discover()
 
 		n := time.Now()
-		b := n.Add(0 - (5 * pollInterval))
+		cutoff := n.Add(0 - (5 * b.pollInterval))
 
-		kasasMu.RLock()
-		for _, k := range kasas {
-			if k.getLastUpdate().Before(b) {
+		b.kasasMu.RLock()
+		for _, k := range b.kasas {
+			if k.getLastUpdate().Before(cutoff) {
 				k.unreachable()
 			}
 		}
-		kasasMu.RUnlock()
+		b.kasasMu.RUnlock()
 
 		select {
 		case <-ctx.Done():
-			log.Info.Printf("poller: contexted canceled")
+			slog.Debug("poller: context canceled")
 			return
 		case <-t.C:
-			// log.Debug.Printf("poller: tick")
 		}
 	}
 }
 
-func discover() {
-	for _, b := range broadcasts {
-		if _, err := packetconn.WriteToUDP(discoverCmd, &net.UDPAddr{IP: b, Port: 9999}); err != nil {
-			log.Info.Printf("discovery failed for %s: %s", b.String(), err.Error())
-			continue
-		}
-	}
-}
-
-func setCountdown(ip net.IP, target bool, dur int) error {
-	k, _ := newKasaIP(ip)
+func (b *Bridge) setCountdown(ip net.IP, target bool, dur int) error {
+	k, _ := b.newKasaIP(ip)
 
 	// remove any existing countdowns
 	if err := k.ClearCountdownRules(); err != nil {
-		log.Info.Println(err.Error())
 		return err
 	}
 
 	// add our new countdown
 	if err := k.AddCountdownRule(dur, target, "added from kasahkb"); err != nil {
-		log.Info.Println(err.Error())
 		return err
 	}
 
 	return nil
 }
 
-func getEmeterUDP(ip net.IP) error {
+func (b *Bridge) getEmeterUDP(ip net.IP) error {
 	payload := kasa.Scramble(kasa.CmdGetEmeter)
 
-	if _, err := packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
-		log.Info.Printf("get emeter failed: %s", err.Error())
+	if _, err := b.packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
+		slog.Warn("get emeter failed", "ip", ip.String(), "err", err)
 		return err
 	}
 
 	return nil
 }
 
-func getEmeterChildUDP(ip net.IP, parent, child string) error {
+func (b *Bridge) getEmeterChildUDP(ip net.IP, parent, child string) error {
 	full := fmt.Sprintf("%s%s", parent, child)
 
 	cmd := fmt.Sprintf(kasa.CmdGetEmeterChild, full)
 	payload := kasa.Scramble(cmd)
 
-	if _, err := packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
-		log.Info.Printf("get emeter child failed: %s", err.Error())
+	if _, err := b.packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
+		slog.Warn("get emeter child failed", "ip", ip.String(), "child", child, "err", err)
 		return err
 	}
 
 	return nil
 }
 
-func getDimmerParametersUDP(ip net.IP) error {
+func (b *Bridge) getDimmerParametersUDP(ip net.IP) error {
 	payload := kasa.Scramble(kasa.CmdGetDimmer)
 
-	if _, err := packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
-		log.Info.Printf("get dimmer parameters failed: %s", err.Error())
+	if _, err := b.packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
+		slog.Warn("get dimmer parameters failed", "ip", ip.String(), "err", err)
 		return err
 	}
 
 	return nil
 }
 
-func updateEmeter(em kasa.EmeterRealtime, ip string) error {
+func (b *Bridge) updateEmeter(em kasa.EmeterRealtime, ip string) error {
 	// this is an acceptable O(n) loop given typical install sizes
-	kasasMu.RLock()
-	for _, device := range kasas {
+	b.kasasMu.RLock()
+	for _, device := range b.kasas {
 		if device.getIPstring() == ip {
 			device.incomingEmeterData(em)
 		}
 	}
-	kasasMu.RUnlock()
+	b.kasasMu.RUnlock()
 
 	return nil
 }
 
-func updateDimmer(dim kasa.Dimmer, ip string) error {
+func (b *Bridge) updateDimmer(dim kasa.Dimmer, ip string) error {
 	// this is an acceptable O(n) loop given typical install sizes
-	kasasMu.RLock()
-	for _, device := range kasas {
+	b.kasasMu.RLock()
+	for _, device := range b.kasas {
 		if device.getIPstring() == ip {
 			device.incomingDimmerData(dim)
 		}
 	}
-	kasasMu.RUnlock()
+	b.kasasMu.RUnlock()
 
 	return nil
 }
 
-func getBrightnessUDP(ip net.IP) error {
+func (b *Bridge) getBrightnessUDP(ip net.IP) error {
 	payload := kasa.Scramble(kasa.CmdGetCurrentBrightness)
 
-	if _, err := packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
-		log.Info.Printf("get brightness failed: %s", err.Error())
+	if _, err := b.packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
+		slog.Warn("get brightness failed", "ip", ip.String(), "err", err)
 		return err
 	}
 
 	return nil
 }
 
-func updateBrightness(b kasa.LightSensorBrightness, ip string) error {
+func (b *Bridge) updateBrightness(brt kasa.LightSensorBrightness, ip string) error {
+	// this is an acceptable O(n) loop given typical install sizes
+	b.kasasMu.RLock()
+	for _, device := range b.kasas {
+		if device.getIPstring() == ip {
+			device.incomingBrightnessData(brt)
+		}
+	}
+	b.kasasMu.RUnlock()
+
+	return nil
+}
+
+func (b *Bridge) getPIRUDP(ip net.IP) error {
+	payload := kasa.Scramble(kasa.CmdGetPIRConfig)
+
+	if _, err := b.packetconn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
+		slog.Warn("get PIR config failed", "ip", ip.String(), "err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (b *Bridge) updatePIR(pir kasa.PIRSensorConfig, ip string) error {
+	if err := pir.OK(); err != nil {
+		slog.Warn("PIR config returned an error", "ip", ip, "err", err)
+		return err
+	}
+
 	// this is an acceptable O(n) loop given typical install sizes
-	kasasMu.RLock()
-	for _, device := range kasas {
+	b.kasasMu.RLock()
+	for _, device := range b.kasas {
 		if device.getIPstring() == ip {
-			device.incomingBrightnessData(b)
+			device.incomingPIRData(pir)
 		}
 	}
-	kasasMu.RUnlock()
+	b.kasasMu.RUnlock()
 
 	return nil
 }
 
-func newKasaIP(ip net.IP) (*kasa.Device, error) {
+func (b *Bridge) newKasaIP(ip net.IP) (*kasa.Device, error) {
 	d := kasa.Device{
 		IP:   ip,
 		Port: 9999,
 		OverrideUDP: func(ctx context.Context, cmd string) error {
-			if _, err := packetconn.WriteToUDP(kasa.Scramble(cmd), &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
-				log.Info.Printf("udp write failed: %s", err.Error())
+			if _, err := b.packetconn.WriteToUDP(kasa.Scramble(cmd), &net.UDPAddr{IP: ip, Port: 9999}); err != nil {
+				slog.Warn("udp write failed", "ip", ip.String(), "err", err)
 				return err
 			}
 			// so we don't overwhelm the breakers when 50 deviced get flipped at once
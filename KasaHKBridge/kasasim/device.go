@@ -0,0 +1,473 @@
+// Package kasasim pretends to be Kasa devices on a local address so the bridge can be exercised without hardware
+package kasasim
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+const port = 9999
+
+// Device is one simulated device answering on ip:9999 over UDP and TCP.
+// Use a different loopback address (127.0.0.2, 127.0.0.3, ...) for each since the port is fixed.
+type Device struct {
+	mu         sync.Mutex
+	ip         net.IP
+	sysinfo    kasa.Sysinfo
+	dimmer     kasa.DimmerParameters
+	load       []uint // watts drawn by each outlet when it is on
+	brightness uint   // raw ambient light reading
+	pir        kasa.PIRSensorConfig
+	rule       *kasa.Rule
+	ruleStart  time.Time
+	ruleSlots  []int // outlets the countdown rule switches
+	cloud      bool
+	cloudUser  string
+	changed    time.Time // relay state change, for on_time
+
+	udp *net.UDPConn
+	tcp *net.TCPListener
+	wg  sync.WaitGroup
+}
+
+// New sets up a device of the given model, call Listen to start answering
+func New(model string, ip net.IP) (*Device, error) {
+	s, err := sysinfoFor(model, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	outlets := max(1, int(s.NumChildren))
+	d := &Device{
+		ip:      ip,
+		sysinfo: s,
+		load:    make([]uint, outlets),
+		changed: time.Now(),
+		dimmer: kasa.DimmerParameters{
+			MinThreshold:  11,
+			FadeOnTime:    1000,
+			FadeOffTime:   1000,
+			GentleOnTime:  3000,
+			GentleOffTime: 10000,
+			RampRate:      30,
+		},
+		brightness: 20,
+		pir: kasa.PIRSensorConfig{
+			Enable:       1,
+			Version:      "1.0",
+			TriggerIndex: 1,
+			ColdTime:     60000,
+			MaxADC:       4095,
+			Data:         []uint{80, 50, 20, 0},
+		},
+		cloud:     true,
+		cloudUser: "sim@example.com",
+	}
+	for i := range d.load {
+		d.load[i] = 60
+	}
+	return d, nil
+}
+
+// Listen starts answering UDP and TCP requests
+func (d *Device) Listen() error {
+	var err error
+	addr := &net.UDPAddr{IP: d.ip, Port: port}
+	if d.udp, err = net.ListenUDP("udp4", addr); err != nil {
+		return err
+	}
+	if d.tcp, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: d.ip, Port: port}); err != nil {
+		d.udp.Close()
+		return err
+	}
+
+	d.wg.Go(d.serveUDP)
+	d.wg.Go(d.serveTCP)
+	return nil
+}
+
+// Close stops the listeners and waits for them to finish
+func (d *Device) Close() error {
+	err := errors.Join(d.udp.Close(), d.tcp.Close())
+	d.wg.Wait()
+	return err
+}
+
+// Sysinfo is what the device would answer to get_sysinfo right now
+func (d *Device) Sysinfo() kasa.Sysinfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expireRule()
+	s := d.sysinfo
+	s.Children = append([]kasa.Child(nil), d.sysinfo.Children...)
+	if s.RelayState > 0 {
+		s.OnTime = int(time.Since(d.changed).Seconds())
+	}
+	return s
+}
+
+// Relay reports the relay state, child is ignored on single outlet devices
+func (d *Device) Relay(child int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.sysinfo.NumChildren == 0 {
+		return d.sysinfo.RelayState > 0
+	}
+	return d.sysinfo.Children[child].RelayState > 0
+}
+
+// Cloud reports if the device is bound to the TP-Link cloud
+func (d *Device) Cloud() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cloud
+}
+
+// SetRelay flips the relay as if someone pressed the button on the device
+func (d *Device) SetRelay(child int, on bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setRelay(child, on)
+}
+
+// SetLoad sets the watts an outlet draws while it is on
+func (d *Device) SetLoad(outlet int, watts uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.load[outlet] = watts
+}
+
+// SetAmbient sets the raw light sensor reading of a KS200M
+func (d *Device) SetAmbient(raw uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.brightness = raw
+}
+
+// SetFirmware changes the firmware version, as if the device updated itself
+func (d *Device) SetFirmware(version string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sysinfo.SWVersion = version
+}
+
+func (d *Device) serveUDP() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := d.udp.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		res := d.handle(kasa.Unscramble(buffer[:n]))
+		if _, err := d.udp.WriteToUDP(kasa.Scramble(string(res)), addr); err != nil {
+			return
+		}
+	}
+}
+
+func (d *Device) serveTCP() {
+	for {
+		conn, err := d.tcp.AcceptTCP()
+		if err != nil {
+			return
+		}
+		d.wg.Go(func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint32(header))
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return
+			}
+
+			res := d.handle(kasa.Unscramble(data))
+			_, _ = conn.Write(kasa.ScrambleTCP(string(res)))
+		})
+	}
+}
+
+type reqContext struct {
+	ChildIDs []string `json:"child_ids"`
+}
+
+// handle answers a request the same way the devices do, one object per module
+func (d *Device) handle(req []byte) []byte {
+	var modules map[string]json.RawMessage
+	if err := json.Unmarshal(req, &modules); err != nil {
+		return []byte(`{"system":{"err_code":-1,"err_msg":"json decode error"}}`)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expireRule()
+
+	var rc reqContext
+	if raw, ok := modules["context"]; ok {
+		_ = json.Unmarshal(raw, &rc)
+		delete(modules, "context")
+	}
+
+	res := make(map[string]any)
+	for module, raw := range modules {
+		var methods map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &methods); err != nil || methods == nil {
+			res[module] = notSupported()
+			continue
+		}
+
+		answers := make(map[string]any)
+		for method, args := range methods {
+			answers[method] = d.call(module, method, args, rc)
+		}
+		res[module] = answers
+	}
+
+	b, _ := json.Marshal(res)
+	return b
+}
+
+func ok() map[string]any {
+	return map[string]any{"err_code": 0}
+}
+
+func notSupported() map[string]any {
+	return map[string]any{"err_code": -1, "err_msg": "module not support"}
+}
+
+// children maps the context child_ids, which are DeviceID + child ID, to slots
+func (d *Device) children(rc reqContext) []int {
+	var slots []int
+	for _, full := range rc.ChildIDs {
+		suffix := strings.TrimPrefix(full, d.sysinfo.DeviceID)
+		for i, c := range d.sysinfo.Children {
+			if c.ID == suffix || c.ID == full {
+				slots = append(slots, i)
+			}
+		}
+	}
+	return slots
+}
+
+func (d *Device) call(module, method string, args json.RawMessage, rc reqContext) any {
+	var in struct {
+		State      int    `json:"state"`
+		Off        int    `json:"off"`
+		Alias      string `json:"alias"`
+		Brightness int    `json:"brightness"`
+		FadeTime   uint   `json:"fadeTime"`
+		Enable     uint   `json:"enable"`
+		Delay      uint   `json:"delay"`
+		Act        uint   `json:"act"`
+		Name       string `json:"name"`
+		ColdTime   uint   `json:"cold_time"`
+		Index      uint   `json:"index"`
+		Value      uint   `json:"value"`
+		Username   string `json:"username"`
+	}
+	if len(args) > 0 {
+		_ = json.Unmarshal(args, &in)
+	}
+
+	switch module + "." + method {
+	case "system.get_sysinfo":
+		s := d.sysinfo
+		if s.RelayState > 0 {
+			s.OnTime = int(time.Since(d.changed).Seconds())
+		}
+		return s
+	case "system.set_relay_state":
+		// without a context a strip switches every outlet
+		if len(rc.ChildIDs) == 0 {
+			for i := range d.load {
+				d.setRelay(i, in.State > 0)
+			}
+		}
+		for _, slot := range d.children(rc) {
+			d.setRelay(slot, in.State > 0)
+		}
+		return ok()
+	case "system.set_led_off":
+		d.sysinfo.LEDOff = uint(in.Off)
+		return ok()
+	case "system.set_dev_alias":
+		if len(rc.ChildIDs) == 0 {
+			d.sysinfo.Alias = in.Alias
+		}
+		for _, slot := range d.children(rc) {
+			d.sysinfo.Children[slot].Alias = in.Alias
+		}
+		return ok()
+	case "system.reboot":
+		return ok()
+	case "emeter.get_realtime":
+		if !hasEmeter(d.sysinfo) {
+			return notSupported()
+		}
+		slot := 0
+		if slots := d.children(rc); len(slots) > 0 {
+			slot = slots[0]
+		}
+		return d.emeter(slot)
+	case "smartlife.iot.dimmer.get_dimmer_parameters":
+		if d.sysinfo.Model != "HS220(US)" {
+			return notSupported()
+		}
+		return d.dimmer
+	case "smartlife.iot.dimmer.set_brightness":
+		d.sysinfo.Brightness = uint(max(0, min(100, in.Brightness)))
+		return ok()
+	case "smartlife.iot.dimmer.set_fade_on_time":
+		d.dimmer.FadeOnTime = in.FadeTime
+		return ok()
+	case "smartlife.iot.dimmer.set_fade_off_time":
+		d.dimmer.FadeOffTime = in.FadeTime
+		return ok()
+	case "smartlife.iot.dimmer.set_gentle_on_time":
+		d.dimmer.GentleOnTime = in.FadeTime
+		return ok()
+	case "smartlife.iot.dimmer.set_gentle_off_time":
+		d.dimmer.GentleOffTime = in.FadeTime
+		return ok()
+	case "smartlife.iot.LAS.get_current_brt":
+		if d.sysinfo.Model != "KS200M(US)" {
+			return notSupported()
+		}
+		// "value" has to come first, the bridge matches on the prefix
+		return kasa.LightSensorBrightness{Value: d.brightness}
+	case "smartlife.iot.PIR.get_config":
+		if d.sysinfo.Model != "KS200M(US)" {
+			return notSupported()
+		}
+		return d.pir
+	case "smartlife.iot.PIR.set_enable":
+		d.pir.Enable = in.Enable
+		return ok()
+	case "smartlife.iot.PIR.set_cold_time":
+		d.pir.ColdTime = in.ColdTime
+		return ok()
+	case "smartlife.iot.PIR.set_trigger_sens":
+		if int(in.Index) >= len(d.pir.Data) {
+			return notSupported()
+		}
+		d.pir.TriggerIndex = in.Index
+		d.pir.Data[in.Index] = in.Value
+		return ok()
+	case "count_down.get_rules":
+		rules := kasa.GetRules{RuleList: []kasa.Rule{}}
+		if d.rule != nil {
+			r := *d.rule
+			r.Remaining = r.Delay - min(r.Delay, uint(time.Since(d.ruleStart).Seconds()))
+			rules.RuleList = append(rules.RuleList, r)
+		}
+		return rules
+	case "count_down.delete_all_rules":
+		d.rule = nil
+		d.sysinfo.ActiveMode = "none"
+		return ok()
+	case "count_down.add_rule":
+		d.rule = &kasa.Rule{ID: "SIMULATED", Name: in.Name, Enable: in.Enable, Delay: in.Delay, Active: in.Act}
+		d.ruleStart = time.Now()
+		// like set_relay_state, without a context the rule is for every outlet
+		d.ruleSlots = d.children(rc)
+		if len(rc.ChildIDs) == 0 {
+			d.ruleSlots = nil
+			for i := range d.load {
+				d.ruleSlots = append(d.ruleSlots, i)
+			}
+		}
+		d.sysinfo.ActiveMode = "count_down"
+		return kasa.AddRule{ID: d.rule.ID}
+	case "netif.get_stainfo":
+		return kasa.StaInfo{SSID: "simulated", KeyType: 3, RSSI: d.sysinfo.RSSI}
+	case "cnCloud.get_info":
+		bound := 0
+		if d.cloud {
+			bound = 1
+		}
+		return map[string]any{"username": d.cloudUser, "server": "n-devs.tplinkcloud.com", "binded": bound, "cld_connection": bound, "err_code": 0}
+	case "cnCloud.bind":
+		d.cloud = true
+		d.cloudUser = in.Username
+		return ok()
+	case "cnCloud.unbind":
+		d.cloud = false
+		d.cloudUser = ""
+		return ok()
+	}
+	return notSupported()
+}
+
+func (d *Device) setRelay(child int, on bool) {
+	state := uint(0)
+	if on {
+		state = 1
+	}
+
+	if d.sysinfo.NumChildren == 0 {
+		if d.sysinfo.RelayState != state {
+			d.changed = time.Now()
+		}
+		d.sysinfo.RelayState = state
+		return
+	}
+	d.sysinfo.Children[child].RelayState = state
+
+	// the strip reports on if any outlet is on
+	d.sysinfo.RelayState = 0
+	for _, c := range d.sysinfo.Children {
+		if c.RelayState > 0 {
+			d.sysinfo.RelayState = 1
+		}
+	}
+}
+
+func (d *Device) emeter(slot int) kasa.EmeterRealtime {
+	on := d.sysinfo.RelayState > 0
+	if d.sysinfo.NumChildren > 0 {
+		on = d.sysinfo.Children[slot].RelayState > 0
+	}
+
+	e := kasa.EmeterRealtime{
+		Slot:      uint(slot),
+		VoltageMV: 120500,
+	}
+	if on {
+		e.PowerMW = d.load[slot] * 1000
+		e.CurrentMA = e.PowerMW / 120
+	}
+	return e
+}
+
+// expireRule runs a countdown rule once its time is up
+func (d *Device) expireRule() {
+	if d.rule == nil || time.Since(d.ruleStart) < time.Duration(d.rule.Delay)*time.Second {
+		return
+	}
+	for _, slot := range d.ruleSlots {
+		d.setRelay(slot, d.rule.Active > 0)
+	}
+	d.rule = nil
+	d.ruleSlots = nil
+	d.sysinfo.ActiveMode = "none"
+}
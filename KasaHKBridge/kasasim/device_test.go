@@ -0,0 +1,219 @@
+package kasasim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+// start runs a simulated model on ip and returns it with a client talking to it over TCP
+func start(t *testing.T, model string, ip net.IP) (*Device, *kasa.Device) {
+	t.Helper()
+	d, err := New(model, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Listen(); err != nil {
+		t.Skipf("unable to listen on %s: %s", ip, err)
+	}
+	t.Cleanup(func() { _ = d.Close() })
+
+	k, err := kasa.NewDeviceIP(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, k
+}
+
+// send runs a raw command over TCP so it has been handled when send returns
+func send(t *testing.T, k *kasa.Device, cmd string, args ...any) {
+	t.Helper()
+	if _, err := k.SendRawCommand(fmt.Sprintf(cmd, args...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sysinfo(t *testing.T, k *kasa.Device) *kasa.Sysinfo {
+	t.Helper()
+	s, err := k.GetSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// countdown adds a rule that is already due, childID is empty for the whole device
+func countdown(t *testing.T, k *kasa.Device, childID string, on bool) {
+	t.Helper()
+	act := 0
+	if on {
+		act = 1
+	}
+	cmd := fmt.Sprintf(kasa.CmdAddCountdownRule, 0, act, "test")
+	if childID != "" {
+		cmd = fmt.Sprintf(`{"context":{"child_ids":["%s"]},%s`, childID, cmd[1:])
+	}
+	send(t, k, "%s", cmd)
+}
+
+func TestHS103(t *testing.T) {
+	d, k := start(t, "HS103(US)", net.IPv4(127, 0, 0, 51))
+
+	send(t, k, kasa.CmdSetRelayState, 1)
+	if !d.Relay(0) {
+		t.Error("relay off after set_relay_state 1")
+	}
+	if s := sysinfo(t, k); s.RelayState != 1 || s.Model != "HS103(US)" || s.NumChildren != 0 {
+		t.Errorf("sysinfo %s relay %d children %d", s.Model, s.RelayState, s.NumChildren)
+	}
+
+	countdown(t, k, "", false)
+	if s := sysinfo(t, k); s.RelayState != 0 {
+		t.Error("countdown rule did not switch the relay off")
+	}
+
+	if _, err := k.GetEmeter(); err == nil {
+		t.Error("HS103 answered emeter.get_realtime")
+	}
+}
+
+func TestHS220(t *testing.T) {
+	d, k := start(t, "HS220(US)", net.IPv4(127, 0, 0, 52))
+
+	send(t, k, kasa.CmdSetBrightness, 40)
+	if s := sysinfo(t, k); s.Brightness != 40 {
+		t.Errorf("brightness %d, want 40", s.Brightness)
+	}
+	send(t, k, kasa.CmdSetBrightness, 150)
+	if s := d.Sysinfo(); s.Brightness != 100 {
+		t.Errorf("brightness %d, want it clamped to 100", s.Brightness)
+	}
+
+	send(t, k, kasa.CmdSetFadeOnTime, 500)
+	p, err := k.GetDimmerParameters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.FadeOnTime != 500 {
+		t.Errorf("fade on time %d, want 500", p.FadeOnTime)
+	}
+}
+
+func TestHS300(t *testing.T) {
+	d, k := start(t, "HS300(US)", net.IPv4(127, 0, 0, 53))
+	s := sysinfo(t, k)
+	if s.NumChildren != 6 || len(s.Children) != 6 {
+		t.Fatalf("%d children, want 6", len(s.Children))
+	}
+
+	child := s.DeviceID + s.Children[2].ID
+	send(t, k, kasa.CmdSetRelayStateChild, child, 1)
+	for i := range 6 {
+		if d.Relay(i) != (i == 2) {
+			t.Errorf("outlet %d is %v", i, d.Relay(i))
+		}
+	}
+	if s := sysinfo(t, k); s.RelayState != 1 {
+		t.Error("strip not on with an outlet on")
+	}
+
+	d.SetLoad(2, 100)
+	e, err := k.GetEmeterChild(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Slot != 2 || e.PowerMW != 100000 {
+		t.Errorf("emeter slot %d %dmW, want slot 2 100000mW", e.Slot, e.PowerMW)
+	}
+
+	// a countdown on an outlet switches that outlet and leaves the rest alone
+	send(t, k, kasa.CmdSetRelayStateChild, s.DeviceID+s.Children[4].ID, 1)
+	countdown(t, k, s.DeviceID+s.Children[4].ID, false)
+	_ = sysinfo(t, k)
+	if d.Relay(4) || !d.Relay(2) || d.Relay(0) {
+		t.Errorf("after the countdown outlets 0, 2, 4 are %v %v %v, want false true false", d.Relay(0), d.Relay(2), d.Relay(4))
+	}
+}
+
+func TestKP115(t *testing.T) {
+	d, k := start(t, "KP115(US)", net.IPv4(127, 0, 0, 54))
+	d.SetLoad(0, 1500)
+
+	e, err := k.GetEmeter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.PowerMW != 0 {
+		t.Errorf("%dmW drawn while off", e.PowerMW)
+	}
+
+	d.SetRelay(0, true)
+	if e, err = k.GetEmeter(); err != nil {
+		t.Fatal(err)
+	}
+	if e.PowerMW != 1500000 || e.VoltageMV == 0 {
+		t.Errorf("%dmW at %dmV, want 1500000mW", e.PowerMW, e.VoltageMV)
+	}
+}
+
+func TestKP303(t *testing.T) {
+	d, k := start(t, "KP303(US)", net.IPv4(127, 0, 0, 55))
+	s := sysinfo(t, k)
+	if len(s.Children) != 3 {
+		t.Fatalf("%d children, want 3", len(s.Children))
+	}
+
+	// without a context every outlet switches
+	send(t, k, kasa.CmdSetRelayState, 1)
+	for i := range 3 {
+		if !d.Relay(i) {
+			t.Errorf("outlet %d off after set_relay_state 1", i)
+		}
+	}
+
+	countdown(t, k, s.DeviceID+s.Children[1].ID, false)
+	_ = sysinfo(t, k)
+	if !d.Relay(0) || d.Relay(1) || !d.Relay(2) {
+		t.Errorf("after the countdown outlets are %v %v %v, want true false true", d.Relay(0), d.Relay(1), d.Relay(2))
+	}
+
+	if _, err := k.GetEmeter(); err == nil {
+		t.Error("KP303 answered emeter.get_realtime")
+	}
+}
+
+func TestKS200M(t *testing.T) {
+	d, k := start(t, "KS200M(US)", net.IPv4(127, 0, 0, 56))
+
+	// go-kasa's GetCurrentBrightness drops the module wrapper, read it the way the bridge does
+	d.SetAmbient(35)
+	res, err := k.SendRawCommand(kasa.CmdGetCurrentBrightness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var las struct {
+		LAS kasa.LightSensor `json:"smartlife.iot.LAS"`
+	}
+	if err := json.Unmarshal(res, &las); err != nil {
+		t.Fatal(err)
+	}
+	if las.LAS.GetBrightness.Value != 35 {
+		t.Errorf("ambient %d, want 35", las.LAS.GetBrightness.Value)
+	}
+
+	send(t, k, kasa.CmdSetPIRColdTime, 120000)
+	d.mu.Lock()
+	cold := d.pir.ColdTime
+	d.mu.Unlock()
+	if cold != 120000 {
+		t.Errorf("cold time %d, want 120000", cold)
+	}
+
+	d.SetFirmware("1.0.1 Build 000001 Rel.000001")
+	if s := sysinfo(t, k); s.SWVersion != "1.0.1 Build 000001 Rel.000001" {
+		t.Errorf("firmware %s after SetFirmware", s.SWVersion)
+	}
+}
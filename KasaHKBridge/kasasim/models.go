@@ -0,0 +1,72 @@
+package kasasim
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+// Models are the devices the simulator knows how to pretend to be
+var Models = []string{"HS103(US)", "HS220(US)", "HS300(US)", "KP115(US)", "KP303(US)", "KS200M(US)"}
+
+// sysinfoFor builds a believable get_sysinfo for the model, the ids are derived from the model and IP so they are stable between runs
+func sysinfoFor(model string, ip net.IP) (kasa.Sysinfo, error) {
+	sum := sha1.Sum([]byte(model + ip.String()))
+	id := strings.ToUpper(fmt.Sprintf("%x", sum))
+	mac := net.HardwareAddr(sum[:6]).String()
+
+	s := kasa.Sysinfo{
+		SWVersion:  "1.0.0 Build 000000 Rel.000000",
+		HWVersion:  "1.0",
+		Model:      model,
+		DeviceID:   id,
+		OEMID:      id[:32],
+		HWID:       id[8:],
+		RSSI:       -50,
+		Alias:      fmt.Sprintf("Simulated %s %s", strings.TrimSuffix(model, "(US)"), ip),
+		Status:     "new",
+		MIC:        "IOT.SMARTPLUGSWITCH",
+		Feature:    "TIM",
+		MAC:        strings.ToUpper(mac),
+		ActiveMode: "none",
+	}
+
+	switch model {
+	case "HS103(US)":
+		s.DevName = "Smart Wi-Fi Plug Lite"
+	case "HS220(US)":
+		s.DevName = "Smart Wi-Fi Dimmer"
+		s.Brightness = 100
+	case "HS300(US)":
+		s.DevName = "Smart Wi-Fi Power Strip"
+		s.Feature = "TIM:ENE"
+		s.NumChildren = 6
+	case "KP303(US)":
+		s.DevName = "Kasa Smart Wi-Fi Power Strip"
+		s.NumChildren = 3
+	case "KP115(US)":
+		s.DevName = "Smart Wi-Fi Plug Mini"
+		s.Feature = "TIM:ENE"
+	case "KS200M(US)":
+		s.DevName = "Smart Light Switch with Motion Sensor"
+	default:
+		return s, fmt.Errorf("unsupported model: %s", model)
+	}
+
+	// the bridge expects the child ID to be the suffix appended to the DeviceID
+	for i := uint(0); i < s.NumChildren; i++ {
+		s.Children = append(s.Children, kasa.Child{
+			ID:    fmt.Sprintf("%02d", i),
+			Alias: fmt.Sprintf("Outlet %d", i+1),
+		})
+	}
+
+	return s, nil
+}
+
+func hasEmeter(s kasa.Sysinfo) bool {
+	return strings.Contains(s.Feature, "ENE")
+}
@@ -1,11 +1,12 @@
 package kasahkbridge
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -15,12 +16,13 @@ import (
 type KP115 struct {
 	*generic
 
-	Outlet *KP115Svc
+	Outlet    *KP115Svc
+	Appliance *applianceSvc // optional, nil unless configured
 }
 
-func NewKP115(k kasa.KasaDevice, ip net.IP) *KP115 {
+func NewKP115(b *Bridge, k kasa.KasaDevice, ip net.IP) *KP115 {
 	acc := KP115{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeOutlet)
@@ -38,25 +40,24 @@ func NewKP115(k kasa.KasaDevice, ip net.IP) *KP115 {
 	acc.Outlet.ProgramMode.SetValue(pm)
 
 	acc.Outlet.On.OnValueRemoteUpdate(func(newstate bool) {
-		log.Info.Printf("[%s] %s", acc.Sysinfo.Alias, boolToState(newstate))
-		k, _ := newKasaIP(acc.ip)
-		if err := k.SetRelayState(newstate); err != nil {
-			log.Info.Println(err.Error())
-			return
+		if err := acc.b.commandRelay(&acc, "", newstate, "homekit"); err != nil {
+			acc.logger().Warn("set relay failed", "err", err)
 		}
-		acc.Outlet.OutletInUse.SetValue(newstate)
 	})
 
 	acc.Outlet.SetDuration.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting duration [%s] to [%d]", acc.Sysinfo.Alias, when)
-		if err := setCountdown(acc.ip, !acc.Outlet.On.Value(), when); err != nil {
-			log.Info.Println(err.Error())
+		acc.logger().Info("set countdown", "seconds", when)
+		if err := acc.b.setCountdown(acc.getIP(), !acc.Outlet.On.Value(), when); err != nil {
+			acc.logger().Warn("set countdown failed", "err", err)
 			return
 		}
 		acc.Outlet.ProgramMode.SetValue(characteristic.ProgramModeProgramScheduled)
 		acc.Outlet.RemainingDuration.SetValue(when)
 	})
 
+	acc.addLED()
+	acc.Appliance = acc.addAppliance()
+
 	return &acc
 }
 
@@ -122,15 +123,16 @@ func (h *KP115) update(k kasa.KasaDevice, ip net.IP) {
 	h.genericUpdate(k, ip)
 
 	if h.Outlet.On.Value() != (k.GetSysinfo.Sysinfo.RelayState > 0) {
-		log.Info.Printf("[%s] %s", k.GetSysinfo.Sysinfo.Alias, intToState(k.GetSysinfo.Sysinfo.RelayState))
+		h.logger().Info("relay", "state", intToState(k.GetSysinfo.Sysinfo.RelayState), "source", "device")
+		h.publish("relay", "", "device", k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Outlet.On.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Outlet.OutletInUse.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 	}
 
-	kd, _ := newKasaIP(ip)
+	kd, _ := h.b.newKasaIP(ip)
 
 	if h.Outlet.ProgramMode.Value() != kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode) {
-		log.Info.Printf("updating HomeKit: [%s] ProgramMode %s", k.GetSysinfo.Sysinfo.Alias, k.GetSysinfo.Sysinfo.ActiveMode)
+		h.logger().Debug("program mode", "mode", k.GetSysinfo.Sysinfo.ActiveMode)
 		h.Outlet.ProgramMode.SetValue(kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode))
 		if k.GetSysinfo.Sysinfo.ActiveMode == "none" {
 			_ = kd.ClearCountdownRules()
@@ -140,9 +142,9 @@ func (h *KP115) update(k kasa.KasaDevice, ip net.IP) {
 	if k.GetSysinfo.Sysinfo.ActiveMode == "count_down" {
 		rules, _ := kd.GetCountdownRules()
 		for _, rule := range rules {
-			log.Info.Printf("%+v", rule)
+			h.logger().Debug("countdown rule", "rule", rule)
 			if rule.Enable > 0 {
-				log.Info.Printf("updating HomeKit: [%s] RemainingDuration %d", k.GetSysinfo.Sysinfo.Alias, rule.Remaining)
+				h.logger().Debug("countdown remaining", "seconds", rule.Remaining)
 				h.Outlet.RemainingDuration.SetValue(int(rule.Remaining))
 			}
 		}
@@ -151,18 +153,18 @@ func (h *KP115) update(k kasa.KasaDevice, ip net.IP) {
 	}
 
 	// request emeter data over UDP, kd.GetEmeter() is TCP
-	if err := getEmeterUDP(h.ip); err != nil {
+	if err := h.b.getEmeterUDP(h.ip); err != nil {
 		return
 	}
 
 	if h.Outlet.On.Value() && h.Outlet.Amp.Value() < 10 {
 		if h.Outlet.StatusFault.Value() == characteristic.StatusFaultNoFault {
-			// log.Info.Printf("ALERT: [%s] is ON but drawing no current!", k.GetSysinfo.Sysinfo.Alias)
+			// h.logger().Warn("on but drawing no current")
 			h.Outlet.StatusFault.SetValue(characteristic.StatusFaultGeneralFault)
 		}
 	} else {
 		if h.Outlet.StatusFault.Value() == characteristic.StatusFaultGeneralFault {
-			// log.Info.Printf("[%s] is ON and drawing current", k.GetSysinfo.Sysinfo.Alias)
+			// h.logger().Info("on and drawing current")
 			h.Outlet.StatusFault.SetValue(characteristic.StatusFaultNoFault)
 		}
 	}
@@ -170,46 +172,74 @@ func (h *KP115) update(k kasa.KasaDevice, ip net.IP) {
 	v := h.Outlet.Volt.Value()
 	switch {
 	case v > 130:
-		log.Info.Printf("[%s] dangerously high voltage: %dV", h.Sysinfo.Alias, v)
+		h.logger().Error("dangerously high voltage, turning off", "volts", v)
 		h.StatusFault.SetValue(characteristic.StatusFaultGeneralFault)
 
-		k, _ := newKasaIP(h.ip)
+		k, _ := h.b.newKasaIP(h.ip)
 		if err := k.SetRelayState(false); err != nil {
-			log.Info.Println(err.Error())
+			h.logger().Warn("unable to turn off", "err", err)
 			return
 		}
 		h.Outlet.On.SetValue(false)
 		h.Outlet.OutletInUse.SetValue(false)
+		h.publish("relay", "", "cutoff", false)
 	case v > 127:
-		log.Info.Printf("[%s] high voltage: %dV", h.Sysinfo.Alias, v)
+		h.logger().Warn("high voltage", "volts", v)
 		if h.StatusFault.Value() == characteristic.StatusFaultGeneralFault {
 			h.StatusFault.SetValue(characteristic.StatusFaultNoFault)
 		}
 	case v < 114:
-		log.Info.Printf("[%s] low voltage: %dV", h.Sysinfo.Alias, v)
+		h.logger().Warn("low voltage", "volts", v)
 		if h.StatusFault.Value() == characteristic.StatusFaultGeneralFault {
 			h.StatusFault.SetValue(characteristic.StatusFaultNoFault)
 		}
 	case v < 110:
-		log.Info.Printf("[%s] dangerously low voltage: %dV", h.Sysinfo.Alias, v)
+		h.logger().Error("dangerously low voltage, turning off", "volts", v)
 		h.StatusFault.SetValue(characteristic.StatusFaultGeneralFault)
 
-		k, _ := newKasaIP(h.ip)
+		k, _ := h.b.newKasaIP(h.ip)
 		if err := k.SetRelayState(false); err != nil {
-			log.Info.Println(err.Error())
+			h.logger().Warn("unable to turn off", "err", err)
 			return
 		}
 		h.Outlet.On.SetValue(false)
 		h.Outlet.OutletInUse.SetValue(false)
+		h.publish("relay", "", "cutoff", false)
 	}
 }
 
 func (h *KP115) incomingEmeterData(e kasa.EmeterRealtime) {
 	if e.Slot > 0 {
-		log.Info.Printf("slot out of bounds: %d", e.Slot)
+		h.logger().Warn("emeter slot out of bounds", "slot", e.Slot)
 	}
 
 	h.Outlet.Volt.SetValue(int(e.VoltageMV / 1000))
 	h.Outlet.Watt.SetValue(int(e.PowerMW / 1000))
 	h.Outlet.Amp.SetValue(int(e.CurrentMA))
+	h.publishEmeter("", e)
+
+	if h.Appliance != nil && h.Appliance.sample(e, time.Now()) {
+		if h.Appliance.running {
+			h.logger().Info("appliance running", "name", h.Appliance.Name.Value())
+		} else {
+			h.logger().Info("appliance done", "name", h.Appliance.Name.Value())
+		}
+	}
+}
+
+func (h *KP115) relay(child string) bool {
+	return h.Outlet.On.Value()
+}
+
+func (h *KP115) setRelay(child string, on bool, source string) error {
+	if child != "" {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay("", on, source); err != nil {
+		return err
+	}
+	h.Outlet.On.SetValue(on)
+	h.Outlet.OutletInUse.SetValue(on)
+	return nil
 }
@@ -7,7 +7,6 @@ import (
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -19,9 +18,9 @@ type KP303 struct {
 	Outlets []*kp303outletSvc
 }
 
-func NewKP303(k kasa.KasaDevice, ip net.IP) *KP303 {
+func NewKP303(b *Bridge, k kasa.KasaDevice, ip net.IP) *KP303 {
 	acc := KP303{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeOutlet)
@@ -40,32 +39,31 @@ func NewKP303(k kasa.KasaDevice, ip net.IP) *KP303 {
 		o.Name.SetValue(acc.Sysinfo.Children[idx].Alias)
 		id := fmt.Sprintf("%s%s", acc.Sysinfo.DeviceID[32:], acc.Sysinfo.Children[idx].ID)
 		o.AccIdentifier.SetValue(id)
-		// log.Info.Printf("Outlet AccID: %s",id)
+		// acc.logger().Debug("outlet", "acc_id", id)
 		if dx, err := strconv.ParseInt(id, 16, 64); err != nil {
-			log.Info.Println(err.Error())
+			acc.logger().Warn("weird outlet ID", "child", acc.Sysinfo.Children[idx].ID, "err", err)
 		} else {
-			// log.Info.Printf("Outlet ID: %d", int(dx))
+			// acc.logger().Debug("outlet", "id", int(dx))
 			o.ID.SetValue(int(dx))
 			o.Id = uint64(dx)
 		}
 
+		// the handlers run on HomeKit's goroutines, so they keep the IDs rather than reading Sysinfo
+		child := acc.Sysinfo.Children[idx].ID
+		full := acc.Sysinfo.DeviceID + child
+		o.child = child
+
 		o.On.OnValueRemoteUpdate(func(newstate bool) {
-			log.Info.Printf("[%s][%d] %s", acc.Sysinfo.Alias, idx, boolToState(newstate))
-			full := fmt.Sprintf("%s%s", acc.Sysinfo.DeviceID, acc.Sysinfo.Children[idx].ID)
-			k, _ := newKasaIP(acc.ip)
-			if err := k.SetRelayStateChild(full, newstate); err != nil {
-				log.Info.Println(err.Error())
-				return
+			if err := acc.b.commandRelay(&acc, child, newstate, "homekit"); err != nil {
+				acc.logger().Warn("set relay failed", "child", child, "err", err)
 			}
-			o.OutletInUse.SetValue(newstate)
 		})
 
 		o.Name.OnValueRemoteUpdate(func(newname string) {
-			log.Info.Printf("[%s][%d] new name %s", acc.Sysinfo.Alias, idx, newname)
-			full := fmt.Sprintf("%s%s", acc.Sysinfo.DeviceID, acc.Sysinfo.Children[idx].ID)
-			k, _ := newKasaIP(acc.ip)
+			acc.logger().Info("renamed from HomeKit", "child", child, "name", newname)
+			k, _ := acc.b.newKasaIP(acc.getIP())
 			if err := k.SetChildAlias(full, newname); err != nil {
-				log.Info.Println(err.Error())
+				acc.logger().Warn("rename failed", "child", child, "err", err)
 				return
 			}
 		})
@@ -74,6 +72,8 @@ func NewKP303(k kasa.KasaDevice, ip net.IP) *KP303 {
 		acc.AddS(o.S)
 	}
 
+	acc.addLED()
+
 	return &acc
 }
 
@@ -82,18 +82,53 @@ func (h *KP303) update(k kasa.KasaDevice, ip net.IP) {
 
 	for i := 0; i < len(h.Outlets); i++ {
 		if h.Outlets[i].On.Value() != (k.GetSysinfo.Sysinfo.Children[i].RelayState > 0) {
-			log.Info.Printf("[%s][%d] %s", k.GetSysinfo.Sysinfo.Alias, i, intToState(k.GetSysinfo.Sysinfo.Children[i].RelayState))
+			h.logger().Info("relay", "child", k.GetSysinfo.Sysinfo.Children[i].ID, "state", intToState(k.GetSysinfo.Sysinfo.Children[i].RelayState), "source", "device")
+			h.publish("relay", k.GetSysinfo.Sysinfo.Children[i].ID, "device", k.GetSysinfo.Sysinfo.Children[i].RelayState > 0)
 			h.Outlets[i].On.SetValue(k.GetSysinfo.Sysinfo.Children[i].RelayState > 0)
 			h.Outlets[i].OutletInUse.SetValue(k.GetSysinfo.Sysinfo.Children[i].RelayState > 0)
 		}
 
 		if h.Outlets[i].Name.Value() != k.GetSysinfo.Sysinfo.Children[i].Alias {
-			log.Info.Printf("updating HomeKit: [%s][%d] name %s", k.GetSysinfo.Sysinfo.Alias, i, k.GetSysinfo.Sysinfo.Children[i].Alias)
+			h.logger().Info("outlet renamed on the device", "child", k.GetSysinfo.Sysinfo.Children[i].ID, "name", k.GetSysinfo.Sysinfo.Children[i].Alias)
 			h.Outlets[i].Name.SetValue(k.GetSysinfo.Sysinfo.Children[i].Alias)
 		}
 	}
 }
 
+// relay with no child is on if any outlet is on
+func (h *KP303) relay(child string) bool {
+	for _, o := range h.Outlets {
+		if (child == "" || o.child == child) && o.On.Value() {
+			return true
+		}
+	}
+	return false
+}
+
+// setRelay with no child switches every outlet
+func (h *KP303) setRelay(child string, on bool, source string) error {
+	slot := -1
+	for i, o := range h.Outlets {
+		if o.child == child {
+			slot = i
+		}
+	}
+	if child != "" && slot < 0 {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay(child, on, source); err != nil {
+		return err
+	}
+	for i, o := range h.Outlets {
+		if slot < 0 || i == slot {
+			o.On.SetValue(on)
+			o.OutletInUse.SetValue(on)
+		}
+	}
+	return nil
+}
+
 type kp303outletSvc struct {
 	*service.S
 
@@ -102,6 +137,8 @@ type kp303outletSvc struct {
 	Name          *characteristic.Name
 	ID            *characteristic.Identifier
 	AccIdentifier *characteristic.AccessoryIdentifier
+
+	child string // child ID, the suffix to the DeviceID
 }
 
 func newkp303OutletSvc() *kp303outletSvc {
@@ -1,11 +1,12 @@
 package kasahkbridge
 
 import (
+	"bytes"
+	"fmt"
 	"net"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
-	"github.com/brutella/hap/log"
 	"github.com/brutella/hap/service"
 
 	"github.com/cloudkucooland/go-kasa"
@@ -17,11 +18,16 @@ type KS200m struct {
 	Switch *KS200mSwitchSvc
 	Light  *service.LightSensor
 	Motion *service.MotionSensor
+
+	raw uint // last light level from the device, before calibration, guarded by mu
+
+	PIR       *pirSvc
+	pirRanges []uint // the sensitivity value the device uses for each range
 }
 
-func NewKS200m(k kasa.KasaDevice, ip net.IP) *KS200m {
+func NewKS200m(b *Bridge, k kasa.KasaDevice, ip net.IP) *KS200m {
 	acc := KS200m{}
-	acc.generic = &generic{}
+	acc.generic = &generic{b: b}
 
 	info := acc.configure(k.GetSysinfo.Sysinfo, ip)
 	acc.A = accessory.New(info, accessory.TypeSwitch)
@@ -37,18 +43,15 @@ func NewKS200m(k kasa.KasaDevice, ip net.IP) *KS200m {
 	acc.Switch.ProgramMode.SetValue(pm)
 
 	acc.Switch.On.OnValueRemoteUpdate(func(newstate bool) {
-		log.Info.Printf("[%s] %s", acc.Sysinfo.Alias, boolToState(newstate))
-		k, _ := newKasaIP(acc.ip)
-		if err := k.SetRelayState(newstate); err != nil {
-			log.Info.Println(err.Error())
-			return
+		if err := acc.b.commandRelay(&acc, "", newstate, "homekit"); err != nil {
+			acc.logger().Warn("set relay failed", "err", err)
 		}
 	})
 
 	acc.Switch.SetDuration.OnValueRemoteUpdate(func(when int) {
-		log.Info.Printf("setting duration [%s] to [%d]", acc.Sysinfo.Alias, when)
-		if err := setCountdown(acc.ip, !acc.Switch.On.Value(), when); err != nil {
-			log.Info.Println(err.Error())
+		acc.logger().Info("set countdown", "seconds", when)
+		if err := acc.b.setCountdown(acc.getIP(), !acc.Switch.On.Value(), when); err != nil {
+			acc.logger().Warn("set countdown failed", "err", err)
 			return
 		}
 		acc.Switch.ProgramMode.SetValue(characteristic.ProgramModeProgramScheduled)
@@ -61,9 +64,75 @@ func NewKS200m(k kasa.KasaDevice, ip net.IP) *KS200m {
 	acc.Light = service.NewLightSensor()
 	acc.AddS(acc.Light.S)
 
+	acc.addLED()
+
+	acc.PIR = newPIRSvc()
+	acc.AddS(acc.PIR.S)
+
+	acc.PIR.Enable.OnValueRemoteUpdate(func(newstate bool) {
+		acc.logger().Info("set motion activation", "state", boolToState(newstate))
+		enable := 0
+		if newstate {
+			enable = 1
+		}
+		if err := acc.sendPIR(fmt.Sprintf(kasa.CmdSetPIREnable, enable)); err != nil {
+			acc.logger().Warn("set motion activation failed", "err", err)
+		}
+	})
+
+	acc.PIR.Range.OnValueRemoteUpdate(func(newrange int) {
+		if newrange >= len(acc.pirRanges) {
+			acc.logger().Warn("motion range unknown to the device", "range", newrange)
+			return
+		}
+		acc.logger().Info("set motion range", "range", newrange)
+		if err := acc.sendPIR(fmt.Sprintf(kasa.CmdSetPIRSensitivity, newrange, acc.pirRanges[newrange])); err != nil {
+			acc.logger().Warn("set motion range failed", "err", err)
+		}
+	})
+
+	acc.PIR.ColdTime.OnValueRemoteUpdate(func(when int) {
+		acc.logger().Info("set motion off delay", "seconds", when)
+		if err := acc.sendPIR(fmt.Sprintf(kasa.CmdSetPIRColdTime, when*1000)); err != nil {
+			acc.logger().Warn("set motion off delay failed", "err", err)
+		}
+	})
+
+	acc.b.getPIRUDP(ip)
+
 	return &acc
 }
 
+// pirSvc holds the motion sensor settings, separate from the MotionSensor so adding it didn't move the other services
+type pirSvc struct {
+	*service.S
+
+	Name     *characteristic.Name
+	Enable   *pirEnable
+	Range    *pirRange
+	ColdTime *pirColdTime
+}
+
+func newPIRSvc() *pirSvc {
+	svc := pirSvc{}
+	svc.S = service.New("E8800001-0000-1000-8000-0026BB765291") // custom
+
+	svc.Name = characteristic.NewName()
+	svc.Name.SetValue("Motion Settings")
+	svc.AddC(svc.Name.C)
+
+	svc.Enable = NewPIREnable()
+	svc.AddC(svc.Enable.C)
+
+	svc.Range = NewPIRRange()
+	svc.AddC(svc.Range.C)
+
+	svc.ColdTime = NewPIRColdTime()
+	svc.AddC(svc.ColdTime.C)
+
+	return &svc
+}
+
 type KS200mSwitchSvc struct {
 	*service.S
 
@@ -101,25 +170,26 @@ func (h *KS200m) update(k kasa.KasaDevice, ip net.IP) {
 	h.genericUpdate(k, ip)
 
 	if h.Switch.On.Value() != (k.GetSysinfo.Sysinfo.RelayState > 0) {
-		log.Info.Printf("[%s] %s", k.GetSysinfo.Sysinfo.Alias, intToState(k.GetSysinfo.Sysinfo.RelayState))
+		h.logger().Info("relay", "state", intToState(k.GetSysinfo.Sysinfo.RelayState), "source", "device")
+		h.publish("relay", "", "device", k.GetSysinfo.Sysinfo.RelayState > 0)
 		h.Switch.On.SetValue(k.GetSysinfo.Sysinfo.RelayState > 0)
 	}
 
 	if h.Switch.ProgramMode.Value() != kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode) {
-		log.Info.Printf("updating HomeKit: [%s] ProgramMode %s", k.GetSysinfo.Sysinfo.Alias, k.GetSysinfo.Sysinfo.ActiveMode)
+		h.logger().Debug("program mode", "mode", k.GetSysinfo.Sysinfo.ActiveMode)
 		h.Switch.ProgramMode.SetValue(kpm2hpm(k.GetSysinfo.Sysinfo.ActiveMode))
 		if k.GetSysinfo.Sysinfo.ActiveMode == "none" {
-			d, _ := newKasaIP(h.ip)
+			d, _ := h.b.newKasaIP(h.ip)
 			_ = d.ClearCountdownRules()
 		}
 	}
 
 	if k.GetSysinfo.Sysinfo.ActiveMode == "count_down" {
-		d, _ := newKasaIP(h.ip)
+		d, _ := h.b.newKasaIP(h.ip)
 		rules, _ := d.GetCountdownRules()
 		for _, rule := range rules {
 			if rule.Enable > 0 {
-				log.Info.Printf("updating HomeKit: [%s] RemainingDuration %d", k.GetSysinfo.Sysinfo.Alias, rule.Remaining)
+				h.logger().Debug("countdown remaining", "seconds", rule.Remaining)
 				h.Switch.RemainingDuration.SetValue(int(rule.Remaining))
 			}
 		}
@@ -127,18 +197,58 @@ func (h *KS200m) update(k kasa.KasaDevice, ip net.IP) {
 		h.Switch.RemainingDuration.SetValue(0)
 	}
 
-	if err := getBrightnessUDP(h.ip); err != nil {
-		log.Info.Println(err.Error())
-	}
+	_ = h.b.getBrightnessUDP(h.ip)
 
+	// changed from the Kasa app or the button on the switch
+	_ = h.b.getPIRUDP(h.ip)
 }
 
 func (h *KS200m) incomingBrightnessData(e kasa.LightSensorBrightness) {
-	h.Light.CurrentAmbientLightLevel.SetValue(convertToLux(e.Value))
+	h.mu.Lock()
+	h.raw = e.Value
+	h.mu.Unlock()
+	h.Light.CurrentAmbientLightLevel.SetValue(h.convertToLux(e.Value))
+}
+
+func (h *KS200m) incomingPIRData(p kasa.PIRSensorConfig) {
+	h.pirRanges = p.Data
+
+	if h.PIR.Enable.Value() != (p.Enable > 0) {
+		h.logger().Info("motion activation", "state", intToState(p.Enable), "source", "device")
+		h.PIR.Enable.SetValue(p.Enable > 0)
+	}
+	if h.PIR.Range.Value() != int(p.TriggerIndex) {
+		h.logger().Info("motion range", "range", p.TriggerIndex, "source", "device")
+		h.PIR.Range.SetValue(int(p.TriggerIndex))
+	}
+	if h.PIR.ColdTime.Value() != int(p.ColdTime/1000) {
+		h.logger().Info("motion off delay", "seconds", p.ColdTime/1000, "source", "device")
+		h.PIR.ColdTime.SetValue(int(p.ColdTime / 1000))
+	}
+}
+
+// sendPIR uses TCP since go-kasa has no setters for the PIR and the reply needs to be checked
+func (h *KS200m) sendPIR(cmd string) error {
+	k, err := h.b.newKasaIP(h.getIP())
+	if err != nil {
+		return err
+	}
+	res, err := k.SendRawCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(res, []byte(`"err_code":0`)) {
+		return fmt.Errorf("[%s] motion setting refused: %s", h.getAlias(), string(res))
+	}
+	return nil
 }
 
-func convertToLux(raw uint) float64 {
-	lux := float64(raw) * 27.0 // guess from 2 small samples
+func (h *KS200m) convertToLux(raw uint) float64 {
+	var lc *LuxConfig
+	if dc, ok := h.b.conf.device(h.Sysinfo.DeviceID, h.Sysinfo.Alias); ok {
+		lc = dc.Lux
+	}
+	lux := lc.lux(raw)
 
 	// HomeKit minimum to avoid "0 Lux / No Response"
 	if lux < 0.1 {
@@ -146,3 +256,30 @@ func convertToLux(raw uint) float64 {
 	}
 	return lux
 }
+
+func (h *KS200m) luxReport() LuxReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return LuxReport{
+		DeviceID: h.Sysinfo.DeviceID,
+		Alias:    h.Sysinfo.Alias,
+		Raw:      h.raw,
+		Lux:      h.Light.CurrentAmbientLightLevel.Value(),
+	}
+}
+
+func (h *KS200m) relay(child string) bool {
+	return h.Switch.On.Value()
+}
+
+func (h *KS200m) setRelay(child string, on bool, source string) error {
+	if child != "" {
+		return fmt.Errorf("[%s] has no outlet %s", h.getAlias(), child)
+	}
+
+	if err := h.sendRelay("", on, source); err != nil {
+		return err
+	}
+	h.Switch.On.SetValue(on)
+	return nil
+}
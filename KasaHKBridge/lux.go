@@ -0,0 +1,86 @@
+package kasahkbridge
+
+import (
+	"fmt"
+	"sort"
+)
+
+// the KS200M reports a raw 0-100ish level, not lux
+const defaultLuxFactor = 27.0 // guess from 2 small samples
+
+// LuxConfig maps the KS200M raw light level to lux, measured with a lux meter (or phone app) next to the switch
+type LuxConfig struct {
+	Factor float64    `json:"factor,omitempty"` // lux per raw step
+	Points []LuxPoint `json:"points,omitempty"` // raw readings with the lux measured at the time, wins over factor
+}
+
+// LuxPoint is one calibration reading
+type LuxPoint struct {
+	Raw uint    `json:"raw"`
+	Lux float64 `json:"lux"`
+}
+
+// LuxReport is the last reading from a KS200M
+type LuxReport struct {
+	DeviceID string  `json:"device_id"`
+	Alias    string  `json:"alias"`
+	Raw      uint    `json:"raw"`
+	Lux      float64 `json:"lux"`
+}
+
+func (l *LuxConfig) validate() error {
+	if l.Factor < 0 {
+		return fmt.Errorf("lux factor can not be negative")
+	}
+
+	sort.Slice(l.Points, func(i, j int) bool {
+		return l.Points[i].Raw < l.Points[j].Raw
+	})
+	for i, p := range l.Points {
+		if p.Lux < 0 {
+			return fmt.Errorf("lux point %d: lux can not be negative", p.Raw)
+		}
+		if i > 0 && l.Points[i-1].Raw == p.Raw {
+			return fmt.Errorf("lux point %d: listed twice", p.Raw)
+		}
+	}
+	return nil
+}
+
+// lux interpolates between the calibration points, the line from the last two carries on past the ends. With no points it is raw * factor.
+func (l *LuxConfig) lux(raw uint) float64 {
+	factor := defaultLuxFactor
+	if l != nil && l.Factor > 0 {
+		factor = l.Factor
+	}
+	if l == nil || len(l.Points) == 0 {
+		return float64(raw) * factor
+	}
+
+	// dark is dark
+	points := l.Points
+	if points[0].Raw > 0 {
+		points = append([]LuxPoint{{Raw: 0, Lux: 0}}, points...)
+	}
+	if len(points) == 1 {
+		return float64(raw) * factor
+	}
+
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Raw >= raw
+	})
+	switch {
+	case i == 0:
+		i = 1
+	case i == len(points):
+		i = len(points) - 1
+	}
+
+	lo, hi := points[i-1], points[i]
+	slope := (hi.Lux - lo.Lux) / float64(hi.Raw-lo.Raw)
+	lux := lo.Lux + slope*(float64(raw)-float64(lo.Raw))
+	if lux < 0 {
+		return 0
+	}
+	return lux
+}
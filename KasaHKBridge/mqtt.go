@@ -0,0 +1,320 @@
+package kasahkbridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// dimmer is a device with a brightness level
+type dimmer interface {
+	brightness() int
+	setBrightness(level int, source string) error // 1-100
+}
+
+// MQTT publishes the device states to the broker and takes commands from it, topics are
+//
+//	prefix/bridge/availability            online, offline
+//	prefix/DeviceID/availability          online, offline
+//	prefix/DeviceID[/child]/state         ON, OFF
+//	prefix/DeviceID[/child]/set           ON, OFF
+//	prefix/DeviceID[/child]/power         watts
+//	prefix/DeviceID[/child]/energy        kWh
+//	prefix/DeviceID/brightness            1-100
+//	prefix/DeviceID/brightness/set        1-100
+func (b *Bridge) MQTT(ctx context.Context) {
+	m := b.conf.MQTT
+	if m == nil {
+		return
+	}
+
+	connected := make(chan struct{}, 1)
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.ClientID).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false). // a slow device doesn't hold up the others
+		SetWill(b.mqttTopic("bridge", "", "availability"), "offline", 1, true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("mqtt connection lost", "err", err)
+		})
+	client := mqtt.NewClient(opts)
+
+	// subscribe before connecting so no change falls between the first announce and the events
+	ch := b.events.subscribe()
+	defer b.events.unsubscribe(ch)
+
+	slog.Info("starting mqtt", "broker", m.Broker)
+	client.Connect() // retries in the background until the broker answers
+
+	// devices are announced once per connection, new devices at the next tick
+	announced := make(map[string]bool)
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("stopping mqtt")
+			if client.IsConnectionOpen() {
+				client.Publish(b.mqttTopic("bridge", "", "availability"), 1, true, "offline").WaitTimeout(time.Second)
+			}
+			client.Disconnect(250)
+			return
+		case <-connected:
+			slog.Info("mqtt connected", "broker", m.Broker)
+			b.mqttPublish(client, b.mqttTopic("bridge", "", "availability"), "online")
+			// the session is clean, so subscribe on every connect
+			client.SubscribeMultiple(map[string]byte{
+				m.Prefix + "/+/set":   1,
+				m.Prefix + "/+/+/set": 1,
+			}, b.mqttCommand)
+			clear(announced)
+			b.mqttAnnounce(client, announced)
+		case <-ticker.C:
+			if client.IsConnectionOpen() {
+				b.mqttAnnounce(client, announced)
+			}
+		case ev := <-ch:
+			if client.IsConnectionOpen() {
+				b.mqttEvent(client, ev)
+			}
+		}
+	}
+}
+
+func (b *Bridge) mqttTopic(id, child, leaf string) string {
+	if child == "" {
+		return fmt.Sprintf("%s/%s/%s", b.conf.MQTT.Prefix, id, leaf)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", b.conf.MQTT.Prefix, id, child, leaf)
+}
+
+// mqttPublish sends a retained message so Home Assistant has the state as soon as it subscribes
+func (b *Bridge) mqttPublish(client mqtt.Client, topic string, payload any) {
+	switch p := payload.(type) {
+	case string, []byte:
+	default:
+		raw, err := json.Marshal(p)
+		if err != nil {
+			slog.Warn("unable to encode mqtt payload", "topic", topic, "err", err)
+			return
+		}
+		payload = raw
+	}
+	client.Publish(topic, 0, true, payload)
+}
+
+// mqttEvent publishes one state change
+func (b *Bridge) mqttEvent(client mqtt.Client, ev Event) {
+	switch ev.Type {
+	case "relay":
+		if on, ok := ev.Value.(bool); ok {
+			b.mqttPublish(client, b.mqttTopic(ev.DeviceID, ev.Child, "state"), onOff(on))
+		}
+	case "brightness":
+		if level, ok := ev.Value.(int); ok {
+			b.mqttPublish(client, b.mqttTopic(ev.DeviceID, ev.Child, "brightness"), strconv.Itoa(level))
+		}
+	case "emeter":
+		if e, ok := ev.Value.(EmeterValue); ok {
+			b.mqttPublish(client, b.mqttTopic(ev.DeviceID, ev.Child, "power"), strconv.FormatFloat(float64(e.PowerMW)/1000, 'f', 1, 64))
+			b.mqttPublish(client, b.mqttTopic(ev.DeviceID, ev.Child, "energy"), strconv.FormatFloat(float64(e.TotalWH)/1000, 'f', 3, 64))
+		}
+	case "reachable":
+		if up, ok := ev.Value.(bool); ok {
+			b.mqttPublish(client, b.mqttTopic(ev.DeviceID, "", "availability"), onlineOffline(up))
+		}
+	}
+}
+
+// mqttAnnounce publishes the current state, and the discovery configs, of the devices not yet announced
+func (b *Bridge) mqttAnnounce(client mqtt.Client, announced map[string]bool) {
+	b.kasasMu.RLock()
+	var devices []kasaDevice
+	for id, k := range b.kasas {
+		if !announced[id] {
+			devices = append(devices, k)
+			announced[id] = true
+		}
+	}
+	b.kasasMu.RUnlock()
+
+	for _, k := range devices {
+		s := k.sysinfo()
+		if b.conf.MQTT.Discovery {
+			b.mqttDiscovery(client, k)
+		}
+
+		b.mqttPublish(client, b.mqttTopic(s.DeviceID, "", "availability"), onlineOffline(k.reachable()))
+		if len(s.Children) == 0 {
+			b.mqttPublish(client, b.mqttTopic(s.DeviceID, "", "state"), onOff(k.relay("")))
+		}
+		for _, c := range s.Children {
+			b.mqttPublish(client, b.mqttTopic(s.DeviceID, c.ID, "state"), onOff(k.relay(c.ID)))
+		}
+		if d, ok := k.(dimmer); ok {
+			b.mqttPublish(client, b.mqttTopic(s.DeviceID, "", "brightness"), strconv.Itoa(d.brightness()))
+		}
+	}
+}
+
+// mqttCommand takes ON/OFF on .../set and 1-100 on .../brightness/set, through the same path as HomeKit. Like the HomeKit
+// handlers it runs on its own goroutine, paho's, so it only reads the device through the accessors that take its lock.
+func (b *Bridge) mqttCommand(_ mqtt.Client, msg mqtt.Message) {
+	// a retained command is stale by the time the bridge sees it
+	if msg.Retained() {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), b.conf.MQTT.Prefix+"/"), "/")
+	payload := strings.TrimSpace(string(msg.Payload()))
+
+	k := b.findDevice(parts[0])
+	if k == nil {
+		slog.Warn("mqtt: unknown device", "topic", msg.Topic())
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "brightness" {
+		d, ok := k.(dimmer)
+		if !ok {
+			k.logger().Warn("mqtt: not a dimmer", "topic", msg.Topic())
+			return
+		}
+		level, err := strconv.Atoi(payload)
+		if err != nil || level < 1 || level > 100 {
+			k.logger().Warn("mqtt: invalid brightness", "payload", payload)
+			return
+		}
+		if err := d.setBrightness(level, "mqtt"); err != nil {
+			k.logger().Warn("set brightness failed", "source", "mqtt", "err", err)
+		}
+		return
+	}
+
+	child := ""
+	if len(parts) == 3 {
+		child = parts[1]
+	}
+
+	var on bool
+	switch strings.ToUpper(payload) {
+	case "ON", "1", "TRUE":
+		on = true
+	case "OFF", "0", "FALSE":
+	default:
+		k.logger().Warn("mqtt: invalid command", "payload", payload)
+		return
+	}
+	if err := b.commandRelay(k, child, on, "mqtt"); err != nil {
+		k.logger().Warn("set relay failed", "child", child, "source", "mqtt", "err", err)
+	}
+}
+
+// mqttDiscovery publishes the Home Assistant discovery configs, a light or switch per relay plus power and energy sensors
+func (b *Bridge) mqttDiscovery(client mqtt.Client, k kasaDevice) {
+	s := k.sysinfo()
+	m := b.conf.MQTT
+	emeter := strings.Contains(s.Feature, "ENE")
+
+	device := map[string]any{
+		"identifiers":  []string{s.DeviceID},
+		"name":         s.Alias,
+		"manufacturer": "TP-Link",
+		"model":        s.Model,
+		"hw_version":   s.HWVersion,
+		"sw_version":   s.SWVersion,
+	}
+	availability := []map[string]string{
+		{"topic": b.mqttTopic("bridge", "", "availability")},
+		{"topic": b.mqttTopic(s.DeviceID, "", "availability")},
+	}
+
+	entity := func(component, child, suffix string, conf map[string]any) {
+		id := "kasa_" + s.DeviceID + child + suffix
+		conf["unique_id"] = id
+		conf["object_id"] = id
+		conf["device"] = device
+		conf["availability"] = availability
+		conf["availability_mode"] = "all"
+		b.mqttPublish(client, fmt.Sprintf("%s/%s/%s/config", m.DiscoveryPrefix, component, id), conf)
+	}
+
+	relay := func(child, name string) {
+		conf := map[string]any{
+			"name":          nil, // the device name
+			"state_topic":   b.mqttTopic(s.DeviceID, child, "state"),
+			"command_topic": b.mqttTopic(s.DeviceID, child, "set"),
+		}
+		if child != "" {
+			conf["name"] = name
+		}
+		component := "switch"
+		if _, ok := k.(dimmer); ok {
+			component = "light"
+			conf["brightness_state_topic"] = b.mqttTopic(s.DeviceID, "", "brightness")
+			conf["brightness_command_topic"] = b.mqttTopic(s.DeviceID, "brightness", "set")
+			conf["brightness_scale"] = 100
+		}
+		entity(component, child, "", conf)
+
+		if !emeter {
+			return
+		}
+		prefix := ""
+		if child != "" {
+			prefix = name + " "
+		}
+		entity("sensor", child, "_power", map[string]any{
+			"name":                prefix + "Power",
+			"state_topic":         b.mqttTopic(s.DeviceID, child, "power"),
+			"device_class":        "power",
+			"state_class":         "measurement",
+			"unit_of_measurement": "W",
+		})
+		entity("sensor", child, "_energy", map[string]any{
+			"name":                prefix + "Energy",
+			"state_topic":         b.mqttTopic(s.DeviceID, child, "energy"),
+			"device_class":        "energy",
+			"state_class":         "total_increasing",
+			"unit_of_measurement": "kWh",
+		})
+	}
+
+	if len(s.Children) == 0 {
+		relay("", s.Alias)
+	}
+	for _, c := range s.Children {
+		relay(c.ID, c.Alias)
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func onlineOffline(up bool) string {
+	if up {
+		return "online"
+	}
+	return "offline"
+}
@@ -0,0 +1,155 @@
+package kasahkbridge
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+const relaystatefilename = "relaystate.json"
+
+// loadRelayState reads the last state HomeKit asked for, keyed by DeviceID then child ID ("" for single outlet devices)
+func (b *Bridge) loadRelayState(path string) error {
+	b.relaysMu.Lock()
+	defer b.relaysMu.Unlock()
+
+	b.relayPath = filepath.Join(path, relaystatefilename)
+	raw, err := os.ReadFile(b.relayPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("unable to open relay state", "err", err)
+		}
+		return err
+	}
+
+	relays := make(map[string]map[string]bool)
+	if err := json.Unmarshal(raw, &relays); err != nil {
+		slog.Warn("relay state unmarshal failed", "err", err)
+		return err
+	}
+	for id, r := range relays {
+		if r != nil {
+			b.relays[id] = r
+		}
+	}
+	return nil
+}
+
+// commandRelay is setRelay for HomeKit and MQTT, what they ask for is remembered for after_outage. Everything the bridge
+// switches by itself (after_outage, groups, the voltage cutoffs) goes around it so it isn't remembered.
+func (b *Bridge) commandRelay(k kasaDevice, child string, on bool, source string) error {
+	if err := k.setRelay(child, on, source); err != nil {
+		return err
+	}
+
+	s := k.sysinfo()
+	switch {
+	case child != "":
+		b.remember(s.DeviceID, child, on)
+	case len(s.Children) == 0:
+		b.remember(s.DeviceID, "", on)
+	default:
+		// without a child a strip switched every outlet
+		for _, c := range s.Children {
+			b.remember(s.DeviceID, c.ID, on)
+		}
+	}
+	return nil
+}
+
+// remember records a relay state commanded from HomeKit or MQTT, it is written out right away since the bridge may lose power too
+func (b *Bridge) remember(id, child string, on bool) {
+	b.relaysMu.Lock()
+	defer b.relaysMu.Unlock()
+
+	if b.relays[id] == nil {
+		b.relays[id] = make(map[string]bool)
+	}
+	if saved, ok := b.relays[id][child]; ok && saved == on {
+		return
+	}
+	b.relays[id][child] = on
+
+	if b.relayPath == "" {
+		return
+	}
+	raw, err := json.Marshal(b.relays)
+	if err != nil {
+		slog.Warn("unable to encode relay state", "err", err)
+		return
+	}
+	if err := os.WriteFile(b.relayPath, raw, 0644); err != nil {
+		slog.Warn("unable to write relay state", "err", err)
+	}
+}
+
+// afterOutage applies the after_outage policy to a device that came back from a power cut, it runs on the Listener
+func (b *Bridge) afterOutage(k kasaDevice) {
+	s := k.sysinfo()
+
+	policy := "restore"
+	if dc, ok := b.conf.device(s.DeviceID, s.Alias); ok && dc.AfterOutage != "" {
+		policy = dc.AfterOutage
+	}
+
+	switch policy {
+	case "none":
+		k.logger().Info("after outage: leaving as is", "policy", policy)
+	case "on", "off":
+		k.logger().Info("after outage: switching", "policy", policy)
+		if err := k.setRelay("", policy == "on", "restore"); err != nil {
+			k.logger().Warn("after outage failed", "err", err)
+		}
+	case "restore":
+		b.relaysMu.Lock()
+		saved := maps.Clone(b.relays[s.DeviceID])
+		b.relaysMu.Unlock()
+
+		for child, on := range saved {
+			if k.relay(child) == on {
+				continue
+			}
+			k.logger().Info("after outage: restoring", "policy", policy, "child", child, "state", boolToState(on))
+			if err := k.setRelay(child, on, "restore"); err != nil {
+				k.logger().Warn("after outage failed", "child", child, "err", err)
+			}
+		}
+	}
+}
+
+// powerCycled guesses if the device lost power while it was unreachable. Kasa devices don't report uptime, but on_time
+// is how long a relay has been on, and it starts from zero again when the device boots. A relay that was on before the
+// device went quiet and is on now, for less than the outage, proves a reboot; one on for longer proves the power stayed
+// on. An off relay proves nothing, it may have been switched off at the device during a Wi-Fi drop, so it is never taken
+// as a power cut, and neither is a device with no relay on beforehand.
+func powerCycled(was, now kasa.Sysinfo, down time.Duration) bool {
+	if len(now.Children) == 0 {
+		return was.RelayState > 0 && rebooted(now.RelayState, now.OnTime, down)
+	}
+
+	before := make(map[string]bool, len(was.Children))
+	for _, c := range was.Children {
+		before[c.ID] = c.RelayState > 0
+	}
+
+	cycled := false
+	for _, c := range now.Children {
+		if c.RelayState > 0 && time.Duration(c.OnTime)*time.Second >= down {
+			return false
+		}
+		if before[c.ID] && rebooted(c.RelayState, c.OnTime, down) {
+			cycled = true
+		}
+	}
+	return cycled
+}
+
+// rebooted is true for a relay that is on, but has been for less than the outage
+func rebooted(state uint, onTime int, down time.Duration) bool {
+	return state > 0 && time.Duration(onTime)*time.Second < down
+}
@@ -0,0 +1,43 @@
+package kasahkbridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudkucooland/go-kasa"
+)
+
+func TestPowerCycled(t *testing.T) {
+	plug := func(state uint, onTime int) kasa.Sysinfo {
+		return kasa.Sysinfo{RelayState: state, OnTime: onTime}
+	}
+	strip := func(children ...kasa.Child) kasa.Sysinfo {
+		return kasa.Sysinfo{Children: children}
+	}
+	child := func(id string, state uint, onTime int) kasa.Child {
+		return kasa.Child{ID: id, RelayState: state, OnTime: onTime}
+	}
+	down := 10 * time.Minute
+
+	tests := []struct {
+		name     string
+		was, now kasa.Sysinfo
+		want     bool
+	}{
+		{"on again since the outage", plug(1, 3600), plug(1, 30), true},
+		{"on through the outage", plug(1, 3600), plug(1, 4200), false},
+		{"switched off during a wifi drop", plug(1, 3600), plug(0, 0), false},
+		{"off before, nothing to go on", plug(0, 0), plug(1, 30), false},
+		{"outlet on again since the outage", strip(child("00", 1, 3600), child("01", 0, 0)), strip(child("00", 1, 30), child("01", 0, 0)), true},
+		{"another outlet stayed on", strip(child("00", 1, 3600), child("01", 1, 3600)), strip(child("00", 1, 30), child("01", 1, 4200)), false},
+		{"outlet switched off during a wifi drop", strip(child("00", 1, 3600), child("01", 0, 0)), strip(child("00", 0, 0), child("01", 0, 0)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := powerCycled(tt.was, tt.now, down); got != tt.want {
+				t.Errorf("powerCycled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package kasahkbridge
+
+import (
+	"sync"
+	"time"
+)
+
+// samples kept per device, an hour at the default poll rate
+const rssiHistorySize = 120
+
+type rssiSample struct {
+	Time time.Time `json:"time"`
+	RSSI int       `json:"rssi"`
+	TCP  bool      `json:"tcp,omitempty"` // read over TCP while UDP was not answering
+}
+
+// wifiStats tracks the connection quality of a single device
+type wifiStats struct {
+	mu      sync.Mutex
+	history []rssiSample // ring buffer
+	next    int
+	flaps   uint // reachable -> unreachable transitions
+	udpLost uint // stopped answering UDP but still answered TCP
+	tcpLost uint // stopped answering both
+	since   time.Time
+}
+
+// WifiReport is what the admin interface shows for each device
+type WifiReport struct {
+	DeviceID  string       `json:"device_id"`
+	Alias     string       `json:"alias"`
+	IP        string       `json:"ip"`
+	Reachable bool         `json:"reachable"`
+	RSSI      int          `json:"rssi"`
+	MinRSSI   int          `json:"min_rssi"`
+	AvgRSSI   int          `json:"avg_rssi"`
+	Flaps     uint         `json:"flaps"`
+	UDPLost   uint         `json:"udp_lost"`
+	TCPLost   uint         `json:"tcp_lost"`
+	Since     time.Time    `json:"since"`
+	History   []rssiSample `json:"history,omitempty"`
+}
+
+func (w *wifiStats) sample(rssi int, tcp bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := rssiSample{Time: time.Now(), RSSI: rssi, TCP: tcp}
+	if w.since.IsZero() {
+		w.since = s.Time
+	}
+	if len(w.history) < rssiHistorySize {
+		w.history = append(w.history, s)
+		return
+	}
+	w.history[w.next] = s
+	w.next = (w.next + 1) % rssiHistorySize
+}
+
+// lost records a reachable -> unreachable transition and if the device still answered over TCP
+func (w *wifiStats) lost(tcpOK bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.flaps++
+	if tcpOK {
+		w.udpLost++
+	} else {
+		w.tcpLost++
+	}
+}
+
+// report fills in the stats, oldest sample first
+func (w *wifiStats) report(r *WifiReport, history bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	r.Flaps = w.flaps
+	r.UDPLost = w.udpLost
+	r.TCPLost = w.tcpLost
+	r.Since = w.since
+
+	if len(w.history) == 0 {
+		return
+	}
+
+	ordered := append(append([]rssiSample{}, w.history[w.next:]...), w.history[:w.next]...)
+	r.RSSI = ordered[len(ordered)-1].RSSI
+	r.MinRSSI = r.RSSI
+	sum := 0
+	for _, s := range ordered {
+		sum += s.RSSI
+		if s.RSSI < r.MinRSSI {
+			r.MinRSSI = s.RSSI
+		}
+	}
+	r.AvgRSSI = sum / len(ordered)
+
+	if history {
+		r.History = ordered
+	}
+}
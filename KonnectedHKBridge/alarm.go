@@ -0,0 +1,645 @@
+package konnectedkhbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/log"
+	"github.com/brutella/hap/service"
+)
+
+// Alarm is the one security system shared by all the boards, every board's zones are services on it
+//
+// It is a state machine, every change goes through setState while holding mu:
+//
+//	disarmed    --arm-->           exit delay (exit_delay > 0) or armed
+//	exit delay  --exit timer-->    armed
+//	exit delay  --arm-->           exit delay, for the new mode
+//	armed       --arm-->           exit delay or armed, for the new mode
+//	armed       --delayed zone-->  entry delay
+//	armed       --instant zone-->  triggered
+//	entry delay --entry timer-->   triggered
+//	entry delay --instant zone-->  triggered
+//	triggered   --siren timer-->   armed if rearm is set, otherwise triggered with the siren off
+//	any         --life safety-->   triggered
+//	any         --disarm-->        disarmed
+//	triggered   --life safety clears while disarmed--> disarmed
+type Alarm struct {
+	*accessory.A
+	SecuritySystem *KonnectedSvc
+	boards         []*Konnected
+	modes          map[string]*ArmMode
+	clock          Clock
+	events         *EventLog
+	webhooks       []*Webhook
+	ctx            context.Context // stops webhooks that are still retrying at shutdown
+	persist        *PersistentState
+	zones          []*alarmZone // the zones that can be bypassed, in config order
+
+	mu    sync.Mutex
+	state alarmState
+	mode  int   // the arm mode asked for, one of the SecuritySystemTargetState values
+	timer Timer // exit, entry or siren timer, at most one runs at a time
+	gen   uint  // bumped whenever the timer changes, so a stale timer does nothing
+}
+
+type alarmState int
+
+const (
+	stateDisarmed alarmState = iota
+	stateExitDelay
+	stateArmed
+	stateEntryDelay
+	stateTriggered
+)
+
+func (s alarmState) String() string {
+	switch s {
+	case stateDisarmed:
+		return "disarmed"
+	case stateExitDelay:
+		return "exit delay"
+	case stateArmed:
+		return "armed"
+	case stateEntryDelay:
+		return "entry delay"
+	case stateTriggered:
+		return "triggered"
+	}
+	return "unknown"
+}
+
+// Clock is where the alarm gets its timers, swapped out to step through the states without waiting
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// buzzer patterns
+const (
+	buzzBeep      = `"state":1, "momentary":120, "times":2, "pause":55`
+	buzzDoorOpen  = `"state":1, "momentary":10, "times":5, "pause":30`
+	buzzDoorClose = `"state":1, "momentary":15, "times":2, "pause":45`
+	buzzMotion    = `"state":1, "momentary":5, "times":3, "pause":50`
+	buzzCountdown = `"state":1, "momentary":50, "pause":450`
+	buzzSiren     = `"state":1`
+	buzzOff       = `"state":0`
+)
+
+func NewAlarm(ctx context.Context, c *Config, stateManager *PersistentState, events *EventLog) *Alarm {
+	a := Alarm{
+		modes:    c.Modes,
+		clock:    realClock{},
+		events:   events,
+		webhooks: c.Webhooks,
+		ctx:      ctx,
+		persist:  stateManager,
+		mode:     stateManager.SecurityMode,
+	}
+
+	var macs []string
+	for _, d := range c.Devices {
+		macs = append(macs, d.Mac)
+	}
+
+	info := accessory.Info{
+		Name:         "konnected", // Name,
+		SerialNumber: strings.Join(macs, ","),
+		Manufacturer: "Konnected.io",
+		Model:        "bootstrap",
+		Firmware:     "bootstrap",
+	}
+
+	a.A = accessory.New(info, accessory.TypeSecuritySystem)
+
+	a.SecuritySystem = NewKonnectedSvc()
+	a.AddS(a.SecuritySystem.S)
+
+	// pick up where we left off, without an exit delay
+	if a.mode != characteristic.SecuritySystemTargetStateDisarm {
+		a.state = stateArmed
+	}
+	a.SecuritySystem.SecuritySystemCurrentState.SetValue(a.currentState())
+	a.SecuritySystem.SecuritySystemTargetState.SetValue(a.mode)
+
+	a.SecuritySystem.SecuritySystemTargetState.OnValueRemoteUpdate(func(newval int) {
+		if newval == characteristic.SecuritySystemTargetStateDisarm {
+			a.disarm("homekit")
+		} else if !a.arm(newval, "homekit") {
+			log.Info.Println("Action ignored: System is currently triggered. Disarm first.")
+			// HomeKit already shows the target it asked for, put back the mode still in force
+			a.mu.Lock()
+			mode := a.mode
+			a.mu.Unlock()
+			a.SecuritySystem.SecuritySystemTargetState.SetValue(mode)
+			return
+		}
+
+		if err := stateManager.UpdateAndSave(newval); err != nil {
+			log.Info.Printf("Failed to persist state: %v", err)
+		}
+	})
+
+	alarmType := characteristic.NewSecuritySystemAlarmType()
+	alarmType.SetValue(1)
+	a.SecuritySystem.AddC(alarmType.C)
+
+	return &a
+}
+
+// addBoard puts a board under the alarm, the first board that answers supplies the model and firmware
+func (a *Alarm) addBoard(k *Konnected, details *system) {
+	if a.Info.FirmwareRevision.Value() == "bootstrap" && details.Software != "bootstrap" {
+		a.Info.Model.SetValue(details.Hardware)
+		a.Info.FirmwareRevision.SetValue(details.Software)
+	}
+	k.buzzes = newBuzzQueue()
+	go k.buzzes.run(a.ctx, k)
+	a.boards = append(a.boards, k)
+}
+
+type KonnectedSvc struct {
+	*service.S
+
+	SecuritySystemCurrentState *characteristic.SecuritySystemCurrentState
+	SecuritySystemTargetState  *characteristic.SecuritySystemTargetState
+}
+
+func NewKonnectedSvc() *KonnectedSvc {
+	s := KonnectedSvc{}
+	s.S = service.New(service.TypeSecuritySystem)
+
+	s.SecuritySystemCurrentState = characteristic.NewSecuritySystemCurrentState()
+	s.AddC(s.SecuritySystemCurrentState.C)
+
+	s.SecuritySystemTargetState = characteristic.NewSecuritySystemTargetState()
+	s.AddC(s.SecuritySystemTargetState.C)
+
+	return &s
+}
+
+// modeName is the config name for a security system state
+func modeName(state int) string {
+	switch state {
+	case characteristic.SecuritySystemCurrentStateStayArm:
+		return "stay"
+	case characteristic.SecuritySystemCurrentStateAwayArm:
+		return "away"
+	case characteristic.SecuritySystemCurrentStateNightArm:
+		return "night"
+	case characteristic.SecuritySystemCurrentStateDisarmed:
+		return "disarm"
+	}
+	return "triggered"
+}
+
+// armMode is the timing for a security system state, the defaults if it isn't configured
+func (a *Alarm) armMode(state int) *ArmMode {
+	if m, ok := a.modes[modeName(state)]; ok {
+		return m
+	}
+	m := defaultArmMode()
+	return &m
+}
+
+// currentState is what HomeKit shows for the state, the zones aren't watched during the exit delay
+func (a *Alarm) currentState() int {
+	switch a.state {
+	case stateArmed, stateEntryDelay:
+		return a.mode
+	case stateTriggered:
+		return characteristic.SecuritySystemCurrentStateAlarmTriggered
+	}
+	return characteristic.SecuritySystemCurrentStateDisarmed
+}
+
+// event is the event log type for entering a state
+func (s alarmState) event() string {
+	switch s {
+	case stateExitDelay:
+		return "exit_delay"
+	case stateEntryDelay:
+		return "countdown"
+	}
+	return s.String()
+}
+
+// setState moves to a new state, tells HomeKit and records it, mu must be held
+func (a *Alarm) setState(s alarmState, source, zone string) {
+	log.Info.Printf("alarm: %s -> %s (%s, %s %s)", a.state, s, modeName(a.mode), source, zone)
+	a.state = s
+	a.SecuritySystem.SecuritySystemCurrentState.SetValue(a.currentState())
+	a.record(s.event(), source, zone, "")
+}
+
+// record adds an event to the log with the current mode and state and fires the webhooks that want it, mu must be held
+func (a *Alarm) record(typ, source, zone, detail string) {
+	e := Event{
+		Time:   time.Now(),
+		Type:   typ,
+		Zone:   zone,
+		Detail: detail,
+		Mode:   modeName(a.mode),
+		State:  a.state.String(),
+		Source: source,
+	}
+	a.events.Record(e)
+
+	for _, w := range a.webhooks {
+		if w.wants(typ) {
+			go w.fire(a.ctx, e)
+		}
+	}
+}
+
+// zoneEvent records a zone opening or closing
+func (a *Alarm) zoneEvent(zone string, state uint8) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	detail := "closed"
+	if state == 1 {
+		detail = "open"
+	}
+	a.record("zone", "http", zone, detail)
+}
+
+// startTimer replaces the running timer, f runs with mu held
+func (a *Alarm) startTimer(d time.Duration, f func()) {
+	a.stopTimer()
+	gen := a.gen
+	a.timer = a.clock.AfterFunc(d, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// stopped or replaced while waiting for the lock
+		if gen != a.gen {
+			return
+		}
+		a.timer = nil
+		f()
+	})
+}
+
+// stopTimer cancels the running timer, mu must be held
+func (a *Alarm) stopTimer() {
+	a.gen++
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+}
+
+// arm starts arming to mode, false if the alarm is going off
+func (a *Alarm) arm(mode int, source string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state == stateEntryDelay || a.state == stateTriggered {
+		return false
+	}
+
+	a.stopTimer()
+	a.mode = mode
+	a.buzzUnlessTriggered(buzzBeep)
+	if err := a.persist.ArmBypasses(); err != nil {
+		log.Info.Printf("Failed to persist bypass: %v", err)
+	}
+
+	delay := time.Duration(a.armMode(mode).ExitDelay) * time.Second
+	if delay == 0 {
+		a.setState(stateArmed, source, "")
+		return true
+	}
+
+	a.setState(stateExitDelay, source, "")
+	a.startTimer(delay, func() {
+		a.setState(stateArmed, "timeout", "")
+		a.buzz(buzzBeep)
+	})
+	return true
+}
+
+// disarm stops everything and silences the siren
+func (a *Alarm) disarm(source string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stopTimer()
+	a.mode = characteristic.SecuritySystemTargetStateDisarm
+	a.buzz(buzzOff)
+	a.setState(stateDisarmed, source, "")
+	a.buzz(buzzBeep)
+
+	// the end of the arming cycle
+	cleared, err := a.persist.ClearCycleBypasses()
+	if err != nil {
+		log.Info.Printf("Failed to persist bypass: %v", err)
+	}
+	for _, id := range cleared {
+		if z := a.zone(id); z != nil {
+			if z.Switch != nil {
+				z.Switch.On.SetValue(false)
+			}
+			a.record("bypass", source, z.name, "cleared")
+		}
+	}
+}
+
+// trip runs a zone's rule for the arm mode, chirp is the buzzer pattern for the chirp rule
+func (a *Alarm) trip(id, name string, rules map[string]string, chirp string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state != stateArmed && a.state != stateEntryDelay {
+		return
+	}
+	if a.persist.Bypassed(id) != nil {
+		log.Info.Printf("%s tripped while %s, bypassed", name, modeName(a.mode))
+		return
+	}
+
+	rule := rules[modeName(a.mode)]
+	log.Info.Printf("%s tripped while %s (%s): %s", name, modeName(a.mode), a.state, rule)
+
+	switch rule {
+	case "chirp":
+		a.buzz(chirp)
+	case "delayed":
+		// already counting down
+		if a.state == stateEntryDelay {
+			return
+		}
+		delay := time.Duration(a.armMode(a.mode).EntryDelay) * time.Second
+		a.setState(stateEntryDelay, "http", name)
+		a.buzz(buzzCountdown)
+		a.startTimer(delay, func() {
+			a.trigger("timeout", name)
+		})
+	case "instant":
+		a.trigger("http", name)
+	}
+}
+
+// lifeSafety sounds the siren whatever the state
+func (a *Alarm) lifeSafety(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.trigger("http", name)
+}
+
+// lifeSafetyClear goes back to disarmed once the danger clears, if nobody armed the system nobody needs to disarm it
+func (a *Alarm) lifeSafetyClear(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state != stateTriggered || a.mode != characteristic.SecuritySystemTargetStateDisarm {
+		return
+	}
+	a.stopTimer()
+	a.buzz(buzzOff)
+	a.setState(stateDisarmed, "http", name)
+}
+
+// trigger sounds the siren until the mode's siren_duration is up, mu must be held
+func (a *Alarm) trigger(source, zone string) {
+	m := a.armMode(a.mode)
+
+	a.setState(stateTriggered, source, zone)
+	a.buzz(buzzSiren)
+
+	a.startTimer(time.Duration(m.SirenDuration)*time.Second, func() {
+		log.Info.Printf("Siren timeout reached (%ds). Silencing.", m.SirenDuration)
+		a.buzz(buzzOff)
+		if m.Rearm && a.mode != characteristic.SecuritySystemTargetStateDisarm {
+			a.setState(stateArmed, "timeout", "")
+			return
+		}
+		a.record("silenced", "timeout", zone, "")
+	})
+}
+
+// chirp sounds a buzzer pattern, unless the siren is going
+func (a *Alarm) chirp(cmd string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.buzzUnlessTriggered(cmd)
+}
+
+// buzzUnlessTriggered sounds a buzzer pattern, unless the siren is going, mu must be held
+func (a *Alarm) buzzUnlessTriggered(cmd string) {
+	if a.state == stateTriggered {
+		log.Info.Println("not chirping since in triggered state")
+		return
+	}
+	a.buzz(cmd)
+}
+
+// buzz queues the same command for the buzzer on every board, it doesn't wait for the boards so it is fine with mu held
+func (a *Alarm) buzz(cmd string) {
+	for _, k := range a.boards {
+		k.buzzes.push(cmd)
+	}
+}
+
+// buzzQueue sends the buzzer commands to one board in order, a board that is slow to answer only holds up itself
+type buzzQueue struct {
+	mu      sync.Mutex
+	pending []string
+	wake    chan struct{}
+}
+
+func newBuzzQueue() *buzzQueue {
+	return &buzzQueue{wake: make(chan struct{}, 1)}
+}
+
+// push adds a command, the siren going on or off makes whatever was still waiting moot
+func (q *buzzQueue) push(cmd string) {
+	q.mu.Lock()
+	if cmd == buzzSiren || cmd == buzzOff {
+		q.pending = q.pending[:0]
+	}
+	q.pending = append(q.pending, cmd)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *buzzQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return "", false
+	}
+	cmd := q.pending[0]
+	q.pending = q.pending[1:]
+	return cmd, true
+}
+
+func (q *buzzQueue) run(ctx context.Context, k *Konnected) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+		for cmd, ok := q.pop(); ok; cmd, ok = q.pop() {
+			if err := k.doBuzz(cmd); err != nil {
+				log.Info.Printf("buzzer on %s: %s", k.ip, err.Error())
+			}
+		}
+	}
+}
+
+// alarmZone is a zone that can be bypassed
+type alarmZone struct {
+	id     string
+	name   string
+	typ    string
+	toggle string // what the HomeKit switch does: cycle, persistent or none
+	Switch *KonnectedBypassSvc
+}
+
+// ZoneStatus is a zone as the admin API shows it
+type ZoneStatus struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Bypass string `json:"bypass,omitempty"` // cycle or persistent
+}
+
+// zoneID names a zone across all the boards
+func zoneID(mac string, pin uint8) string {
+	return fmt.Sprintf("%s-%d", mac, pin)
+}
+
+// addZone registers a zone that follows the arming rules, the others can't be bypassed
+func (a *Alarm) addZone(id string, z Zone) {
+	if defaultRules[z.Type] == nil {
+		return
+	}
+	a.zones = append(a.zones, &alarmZone{
+		id:     id,
+		name:   z.Name,
+		typ:    z.Type,
+		toggle: z.BypassSwitch,
+	})
+}
+
+// addBypassSwitches adds the HomeKit switches, after every board's sensors so the sensors keep their ids
+func (a *Alarm) addBypassSwitches() {
+	for _, z := range a.zones {
+		if z.toggle == "none" {
+			continue
+		}
+		z.Switch = NewKonnectedBypassSvc("Bypass " + z.name)
+		z.Switch.On.SetValue(a.persist.Bypassed(z.id) != nil)
+		z.Switch.On.OnValueRemoteUpdate(func(on bool) {
+			if err := a.setBypass(z.id, on, z.toggle == "persistent", "homekit"); err != nil {
+				log.Info.Printf("bypass %s: %s", z.name, err.Error())
+			}
+		})
+		a.AddS(z.Switch.S)
+	}
+}
+
+func (a *Alarm) zone(id string) *alarmZone {
+	for _, z := range a.zones {
+		if z.id == id {
+			return z
+		}
+	}
+	return nil
+}
+
+var errUnknownZone = errors.New("unknown zone")
+
+// setBypass bypasses a zone, or clears the bypass, for one arming cycle or until cleared
+func (a *Alarm) setBypass(id string, on, persistent bool, source string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	z := a.zone(id)
+	if z == nil {
+		return fmt.Errorf("%w %s", errUnknownZone, id)
+	}
+
+	var b *Bypass
+	detail := "cleared"
+	if on {
+		b = &Bypass{Persistent: persistent}
+		detail = "cycle"
+		if persistent {
+			detail = "persistent"
+		}
+		// bypassed while armed, this cycle is the one
+		if a.state != stateDisarmed && !persistent {
+			b.Armed = true
+		}
+	}
+	if err := a.persist.SetBypass(id, b); err != nil {
+		return err
+	}
+
+	log.Info.Printf("bypass %s: %s", z.name, detail)
+	if z.Switch != nil {
+		z.Switch.On.SetValue(on)
+	}
+	a.record("bypass", source, z.name, detail)
+	return nil
+}
+
+// Zones lists the zones that can be bypassed
+func (a *Alarm) Zones() []ZoneStatus {
+	list := []ZoneStatus{}
+	for _, z := range a.zones {
+		s := ZoneStatus{ID: z.id, Name: z.name, Type: z.typ}
+		if b := a.persist.Bypassed(z.id); b != nil {
+			s.Bypass = "cycle"
+			if b.Persistent {
+				s.Bypass = "persistent"
+			}
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// defaultRules is what each zone type does when it trips in each arm mode, unless the zone's rules say otherwise
+var defaultRules = map[string]map[string]string{
+	"door":       {"stay": "chirp", "away": "delayed", "night": "instant"},
+	"motion":     {"stay": "ignore", "away": "delayed", "night": "chirp"},
+	"glassbreak": {"stay": "instant", "away": "instant", "night": "instant"},
+}
+
+// zoneRules merges a zone's rules over the defaults for its type
+func zoneRules(z Zone) map[string]string {
+	rules := make(map[string]string)
+	for mode, rule := range defaultRules[z.Type] {
+		rules[mode] = rule
+	}
+	for mode, rule := range z.Rules {
+		rules[mode] = rule
+	}
+	return rules
+}
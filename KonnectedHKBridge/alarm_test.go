@@ -0,0 +1,276 @@
+package konnectedkhbridge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+)
+
+// fakeClock hands out timers that only go off when the test fires them
+type fakeClock struct {
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{d: d, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	was := !t.stopped
+	t.stopped = true
+	return was
+}
+
+// fire runs the newest timer, whether or not it was stopped, as time.AfterFunc can when Stop loses the race
+func (c *fakeClock) fire(tb testing.TB, want time.Duration) {
+	tb.Helper()
+	if len(c.timers) == 0 {
+		tb.Fatal("no timer to fire")
+	}
+	c.fireTimer(tb, len(c.timers)-1, want)
+}
+
+func (c *fakeClock) fireTimer(tb testing.TB, i int, want time.Duration) {
+	tb.Helper()
+	t := c.timers[i]
+	if t.d != want {
+		tb.Fatalf("timer %d is %s, want %s", i, t.d, want)
+	}
+	t.f()
+}
+
+const (
+	stay   = characteristic.SecuritySystemTargetStateStayArm
+	away   = characteristic.SecuritySystemTargetStateAwayArm
+	night  = characteristic.SecuritySystemTargetStateNightArm
+	disarm = characteristic.SecuritySystemTargetStateDisarm
+)
+
+func newTestAlarm(tb testing.TB, modes map[string]*ArmMode) (*Alarm, *fakeClock) {
+	tb.Helper()
+	state := NewPersistentState(filepath.Join(tb.TempDir(), "state.json"))
+	a := NewAlarm(context.Background(), &Config{Modes: modes}, state, nil)
+	clock := &fakeClock{}
+	a.clock = clock
+	a.zones = append(a.zones, &alarmZone{id: "front", name: "Front Door", typ: "door", toggle: "none"})
+	return a, clock
+}
+
+var doorRules = zoneRules(Zone{Type: "door"})
+
+// homekitTarget sets the target state as a HomeKit controller would, which runs the handler
+func homekitTarget(a *Alarm, mode int) {
+	a.SecuritySystem.SecuritySystemTargetState.SetValueRequest(mode, httptest.NewRequest(http.MethodPut, "/characteristics", nil))
+}
+
+func TestAlarmTransitions(t *testing.T) {
+	modes := map[string]*ArmMode{
+		"stay":  {EntryDelay: 30, ExitDelay: 0, SirenDuration: 60},
+		"away":  {EntryDelay: 30, ExitDelay: 45, SirenDuration: 60},
+		"night": {EntryDelay: 30, ExitDelay: 0, SirenDuration: 60, Rearm: true},
+	}
+
+	type step struct {
+		do   func(a *Alarm, c *fakeClock)
+		want alarmState
+	}
+	// arm and disarm go through the target characteristic the way HomeKit sets it
+	arm := func(mode int) func(*Alarm, *fakeClock) {
+		return func(a *Alarm, _ *fakeClock) { homekitTarget(a, mode) }
+	}
+	fire := func(d uint) func(*Alarm, *fakeClock) {
+		return func(_ *Alarm, c *fakeClock) { c.fire(t, time.Duration(d)*time.Second) }
+	}
+	trip := func(a *Alarm, _ *fakeClock) { a.trip("front", "Front Door", doorRules, buzzDoorOpen) }
+	disarmed := func(a *Alarm, _ *fakeClock) { homekitTarget(a, disarm) }
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"disarmed, exit delay, armed", []step{
+			{arm(away), stateExitDelay},
+			{fire(45), stateArmed},
+		}},
+		{"no exit delay arms at once", []step{
+			{arm(stay), stateArmed},
+		}},
+		{"armed, entry delay, triggered", []step{
+			{arm(away), stateExitDelay},
+			{fire(45), stateArmed},
+			{trip, stateEntryDelay},
+			{fire(30), stateTriggered},
+		}},
+		{"a second trip keeps counting down", []step{
+			{arm(away), stateExitDelay},
+			{fire(45), stateArmed},
+			{trip, stateEntryDelay},
+			{trip, stateEntryDelay},
+			{fire(30), stateTriggered},
+		}},
+		{"disarm during the entry delay", []step{
+			{arm(away), stateExitDelay},
+			{fire(45), stateArmed},
+			{trip, stateEntryDelay},
+			{disarmed, stateDisarmed},
+		}},
+		{"instant zone triggers", []step{
+			{arm(night), stateArmed},
+			{trip, stateTriggered},
+		}},
+		{"chirp zone stays armed", []step{
+			{arm(stay), stateArmed},
+			{trip, stateArmed},
+		}},
+		{"zones are ignored during the exit delay", []step{
+			{arm(away), stateExitDelay},
+			{trip, stateExitDelay},
+		}},
+		{"siren timeout rearms", []step{
+			{arm(night), stateArmed},
+			{trip, stateTriggered},
+			{fire(60), stateArmed},
+		}},
+		{"siren timeout stays triggered without rearm", []step{
+			{arm(away), stateExitDelay},
+			{fire(45), stateArmed},
+			{trip, stateEntryDelay},
+			{fire(30), stateTriggered},
+			{fire(60), stateTriggered},
+		}},
+		{"arming is refused while triggered", []step{
+			{arm(night), stateArmed},
+			{trip, stateTriggered},
+			{arm(stay), stateTriggered},
+			{disarmed, stateDisarmed},
+		}},
+		{"a refused arm puts the HomeKit target back", []step{
+			{func(a *Alarm, _ *fakeClock) { a.lifeSafety("Kitchen Smoke") }, stateTriggered},
+			{arm(away), stateTriggered},
+		}},
+		{"rearming switches mode", []step{
+			{arm(stay), stateArmed},
+			{arm(away), stateExitDelay},
+			{fire(45), stateArmed},
+		}},
+		{"bypassed zone does not trip", []step{
+			{func(a *Alarm, _ *fakeClock) { a.setBypass("front", true, false, "api") }, stateDisarmed},
+			{arm(night), stateArmed},
+			{trip, stateArmed},
+		}},
+		{"life safety while disarmed, then clears", []step{
+			{func(a *Alarm, _ *fakeClock) { a.lifeSafety("Kitchen Smoke") }, stateTriggered},
+			{func(a *Alarm, _ *fakeClock) { a.lifeSafetyClear("Kitchen Smoke") }, stateDisarmed},
+		}},
+		{"life safety while disarmed, siren timeout stays triggered", []step{
+			{func(a *Alarm, _ *fakeClock) { a.lifeSafety("Kitchen Smoke") }, stateTriggered},
+			{fire(300), stateTriggered},
+		}},
+		{"life safety clearing while armed needs a disarm", []step{
+			{arm(stay), stateArmed},
+			{func(a *Alarm, _ *fakeClock) { a.lifeSafety("Kitchen Smoke") }, stateTriggered},
+			{func(a *Alarm, _ *fakeClock) { a.lifeSafetyClear("Kitchen Smoke") }, stateTriggered},
+			{disarmed, stateDisarmed},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, clock := newTestAlarm(t, modes)
+			for i, s := range tt.steps {
+				s.do(a, clock)
+				if a.state != s.want {
+					t.Fatalf("step %d: state %s, want %s", i, a.state, s.want)
+				}
+				if got := a.SecuritySystem.SecuritySystemCurrentState.Value(); got != a.currentState() {
+					t.Fatalf("step %d: HomeKit shows %d, want %d", i, got, a.currentState())
+				}
+				if got := a.SecuritySystem.SecuritySystemTargetState.Value(); got != a.mode {
+					t.Fatalf("step %d: HomeKit target %s, want %s", i, modeName(got), modeName(a.mode))
+				}
+			}
+		})
+	}
+}
+
+func TestAlarmStaleTimers(t *testing.T) {
+	a, clock := newTestAlarm(t, map[string]*ArmMode{
+		"away":  {EntryDelay: 30, ExitDelay: 45, SirenDuration: 60},
+		"night": {EntryDelay: 30, ExitDelay: 20, SirenDuration: 60},
+	})
+
+	// arming again replaces the exit timer, the first one going off late does nothing
+	a.arm(away, "homekit")
+	a.arm(night, "homekit")
+	clock.fireTimer(t, 0, 45*time.Second)
+	if a.state != stateExitDelay {
+		t.Fatalf("stale exit timer moved the state to %s", a.state)
+	}
+	clock.fireTimer(t, 1, 20*time.Second)
+	if a.state != stateArmed || a.mode != night {
+		t.Fatalf("state %s mode %s, want armed night", a.state, modeName(a.mode))
+	}
+
+	// a disarm during the entry delay leaves the entry timer stale
+	a.trip("front", "Front Door", map[string]string{"night": "delayed"}, buzzDoorOpen)
+	a.disarm("homekit")
+	if !clock.timers[len(clock.timers)-1].stopped {
+		t.Fatal("disarm left the entry timer running")
+	}
+	clock.fire(t, 30*time.Second)
+	if a.state != stateDisarmed {
+		t.Fatalf("stale entry timer moved the state to %s", a.state)
+	}
+}
+
+func TestBuzzQueue(t *testing.T) {
+	q := newBuzzQueue()
+	q.push(buzzBeep)
+	q.push(buzzDoorOpen)
+	q.push(buzzSiren)
+	q.push(buzzOff)
+	q.push(buzzBeep)
+
+	// the siren going on or off drops the patterns still waiting
+	want := []string{buzzOff, buzzBeep}
+	for _, w := range want {
+		cmd, ok := q.pop()
+		if !ok || cmd != w {
+			t.Fatalf("pop = %q, %v, want %q", cmd, ok, w)
+		}
+	}
+	if cmd, ok := q.pop(); ok {
+		t.Fatalf("pop = %q, want empty", cmd)
+	}
+}
+
+func TestAlarmDisarmModeSiren(t *testing.T) {
+	c := Config{
+		Devices: []Device{{Mac: "f4cfa26a0000", Password: "secret", Zones: []Zone{{Pin: 6, Name: "Kitchen Smoke", Type: "smoke"}}}},
+		Modes:   map[string]*ArmMode{"disarm": {SirenDuration: 10, Rearm: true}},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	a, clock := newTestAlarm(t, c.Modes)
+
+	a.lifeSafety("Kitchen Smoke")
+	// rearm never arms a system nobody armed
+	clock.fire(t, 10*time.Second)
+	if a.state != stateTriggered || a.mode != disarm {
+		t.Fatalf("state %s mode %s, want triggered disarm", a.state, modeName(a.mode))
+	}
+}
@@ -30,6 +30,11 @@ func main() {
 				Value: "khkb.json",
 				Usage: "configuration file",
 			},
+			&cli.BoolFlag{
+				Name:  "provision",
+				Value: false,
+				Usage: "write the configured zones to the boards, without this the changes are only logged",
+			},
 			&cli.BoolFlag{
 				Name:  "debug",
 				Value: false,
@@ -41,6 +46,7 @@ func main() {
 				log.Debug.Enable()
 				konnectedkhbridge.StrictHTTP = true
 			}
+			konnectedkhbridge.AllowProvision = cmd.Bool("provision")
 
 			dir := cmd.String("dir")
 			file := cmd.String("config")
@@ -56,11 +62,17 @@ func main() {
 				return fmt.Errorf("could not initialize config: %w", err)
 			}
 
+			events, err := konnectedkhbridge.NewEventLog(filepath.Join(fulldir, "events.jsonl"), conf.EventLog)
+			if err != nil {
+				log.Info.Printf("Warning: could not open event log: %v", err)
+			}
+			defer events.Close()
+
 			var wg sync.WaitGroup
 
 			// Start HTTP service for Konnected hardware callbacks
 			wg.Go(func() {
-				konnectedkhbridge.HTTPServer(ctx, conf.ListenAddr)
+				konnectedkhbridge.HTTPServer(ctx, conf.ListenAddr, conf.AdminToken, events)
 			})
 
 			statePath := filepath.Join(fulldir, "state.json")
@@ -70,7 +82,7 @@ func main() {
 			}
 
 			// Initialize and provision devices
-			devices, err := konnectedkhbridge.Startup(ctx, conf, stateManager)
+			devices, err := konnectedkhbridge.Startup(ctx, conf, stateManager, events)
 			if err != nil {
 				return err
 			}
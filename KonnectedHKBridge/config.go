@@ -14,6 +14,38 @@ type Config struct {
 	Pin        string // HomeKit setup pin (80899303)
 	ListenAddr string // ip:port we listen on for updates from konnected devices (192.168.1.2:8999)
 	Devices    []Device
+	Modes      map[string]*ArmMode // timing per arm mode: stay, away, night
+	EventLog   int64               // bytes the event log grows to before it rotates (1048576)
+	Webhooks   []*Webhook          // requests made when the alarm changes state
+	AdminToken string              // bearer token for the event log and the zones in the admin API, both are off if empty
+}
+
+// ArmMode is the timing for one arm mode, unset fields take the defaults.
+// The "disarm" mode is for a life-safety zone going off while disarmed, only its siren_duration is used.
+type ArmMode struct {
+	EntryDelay    uint `json:"entry_delay"`    // seconds a delayed zone waits before the siren (60)
+	ExitDelay     uint `json:"exit_delay"`     // seconds after arming before the zones are watched (0)
+	SirenDuration uint `json:"siren_duration"` // seconds the siren sounds (300)
+	Rearm         bool `json:"rearm"`          // go back to armed when the siren stops, rather than staying triggered (false)
+}
+
+func defaultArmMode() ArmMode {
+	return ArmMode{
+		EntryDelay:    60,
+		ExitDelay:     0,
+		SirenDuration: 300,
+	}
+}
+
+// UnmarshalJSON starts from the defaults so a mode only needs the fields it changes
+func (m *ArmMode) UnmarshalJSON(b []byte) error {
+	type plain ArmMode
+	p := plain(defaultArmMode())
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*m = ArmMode(p)
+	return nil
 }
 
 type Device struct {
@@ -26,9 +58,14 @@ type Device struct {
 // exposed in accessory.KonnectedZones
 type Zone struct {
 	Name string `json:"name"`
-	Type string `json:"type"`
+	Type string `json:"type"` // motion, door, glassbreak, smoke, co, leak (chirps, never the siren), buzzer, temperature, temp_humidity or unused
 	// Actuator actuator `json:"actuator",omitempty`
-	Pin uint8 `json:"pin"`
+	Pin     uint8  `json:"pin"`
+	Poll    uint   `json:"poll_interval,omitempty"` // minutes between readings for temperature and temp_humidity (3)
+	Trigger *uint8 `json:"trigger,omitempty"`       // actuators only, 1 drives the pin high when on, 0 drives it low (1)
+
+	Rules        map[string]string `json:"rules,omitempty"`         // per arm mode (stay, away, night): ignore, chirp, delayed or instant
+	BypassSwitch string            `json:"bypass_switch,omitempty"` // what the HomeKit bypass switch does: cycle, persistent or none (none)
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -1,9 +1,7 @@
 package konnectedkhbridge
 
 import (
-	"context"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/brutella/hap/accessory"
@@ -12,84 +10,48 @@ import (
 	"github.com/brutella/hap/service"
 )
 
+// Konnected is one board, its zones are services on the shared Alarm
 type Konnected struct {
-	*accessory.A
-	pins           map[uint8]PinHandler
-	SecuritySystem *KonnectedSvc
-	Buzzer         *KonnectedBuzzer
-	ip             string
-	password       string
-
-	alarmCancel context.CancelFunc
-	mu          sync.Mutex
+	pins     map[uint8]PinHandler
+	zones    map[uint8]Zone
+	alarm    *Alarm
+	Buzzer   *KonnectedBuzzer
+	buzzes   *buzzQueue // commands from the alarm, set by addBoard
+	ip       string
+	password string
+	firmware string
 }
 
-func NewKonnected(details *system, d *Device, stateManager *PersistentState) *Konnected {
+func NewKonnected(details *system, d *Device, alarm *Alarm) *Konnected {
 	acc := Konnected{
-		pins: make(map[uint8]PinHandler),
-	}
-
-	info := accessory.Info{
-		Name:         "konnected", // Name,
-		SerialNumber: details.Mac,
-		Manufacturer: "Konnected.io",
-		Model:        details.Hardware,
-		Firmware:     details.Software,
+		pins:     make(map[uint8]PinHandler),
+		zones:    make(map[uint8]Zone),
+		alarm:    alarm,
+		firmware: details.Software,
 	}
 
-	acc.A = accessory.New(info, accessory.TypeSecuritySystem)
 	acc.ip = fmt.Sprintf("%s:%d", details.IP, details.Port)
 	acc.password = d.Password
 
-	acc.SecuritySystem = NewKonnectedSvc()
-	acc.AddS(acc.SecuritySystem.S)
-	acc.SecuritySystem.SecuritySystemCurrentState.SetValue(stateManager.SecurityMode)
-	acc.SecuritySystem.SecuritySystemTargetState.SetValue(stateManager.SecurityMode)
-
-	acc.SecuritySystem.SecuritySystemTargetState.OnValueRemoteUpdate(func(newval int) {
-		current := acc.SecuritySystem.SecuritySystemCurrentState.Value()
-
-		if newval == characteristic.SecuritySystemTargetStateDisarm {
-			log.Info.Println("System Disarmed: Stopping all alarm logic")
-			acc.stopAllAlarmLogic()
-			acc.SecuritySystem.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
-			acc.beep()
-			if err := stateManager.UpdateAndSave(newval); err != nil {
-				log.Info.Printf("Failed to persist state: %v", err)
-			}
-			return
-		}
-
-		// Prevent state changes if already triggered (unless disarming)
-		if current == characteristic.SecuritySystemCurrentStateAlarmTriggered {
-			log.Info.Println("Action ignored: System is currently triggered. Disarm first.")
-			return
-		}
-
-		acc.SecuritySystem.SecuritySystemCurrentState.SetValue(newval)
-		acc.beep()
-
-		if err := stateManager.UpdateAndSave(newval); err != nil {
-			log.Info.Printf("Failed to persist state: %v", err)
-		}
-	})
-
-	alarmType := characteristic.NewSecuritySystemAlarmType()
-	alarmType.SetValue(1)
-	acc.SecuritySystem.AddC(alarmType.C)
-
 	// convert zones from config to pins
 	for _, v := range d.Zones {
+		acc.zones[v.Pin] = v
+		id := zoneID(d.Mac, v.Pin)
+		alarm.addZone(id, v)
 		switch v.Type {
 		case "motion":
 			p := NewKonnectedMotionSensor(v.Name)
+			p.rules = zoneRules(v)
+			p.id = id
 			acc.pins[v.Pin] = p
-			acc.A.AddS(p.S)
+			alarm.AddS(p.S)
 			log.Info.Printf("Konnected Pin: %d: %s (motion)", v.Pin, v.Name)
 		case "door":
 			p := NewKonnectedContactSensor(v.Name)
+			p.rules = zoneRules(v)
+			p.id = id
 			acc.pins[v.Pin] = p
-			acc.A.AddS(p.S)
+			alarm.AddS(p.S)
 			log.Info.Printf("Konnected Pin: %d: %s (contact)", v.Pin, v.Name)
 		case "buzzer":
 			p := NewKonnectedBuzzer(v.Name)
@@ -99,7 +61,7 @@ func NewKonnected(details *system, d *Device, stateManager *PersistentState) *Ko
 					return
 				}
 				go func() {
-					acc.beep()
+					alarm.chirp(buzzBeep)
 					time.Sleep(5 * time.Second)
 					p.Switch.On.SetValue(false)
 				}()
@@ -107,6 +69,29 @@ func NewKonnected(details *system, d *Device, stateManager *PersistentState) *Ko
 			acc.pins[v.Pin] = p
 			acc.Buzzer = p
 			log.Info.Printf("Konnected Pin: %d: %s (buzzer)", v.Pin, v.Name)
+		case "smoke", "co", "leak":
+			p := NewKonnectedSafetySensor(v.Type, v.Name)
+			acc.pins[v.Pin] = p
+			alarm.AddS(p.S)
+			log.Info.Printf("Konnected Pin: %d: %s (%s)", v.Pin, v.Name, v.Type)
+		case "glassbreak":
+			p := &KonnectedGlassBreakSensor{NewKonnectedContactSensor(v.Name)}
+			p.rules = zoneRules(v)
+			p.id = id
+			acc.pins[v.Pin] = p
+			alarm.AddS(p.S)
+			log.Info.Printf("Konnected Pin: %d: %s (glass break)", v.Pin, v.Name)
+		case "temperature":
+			p := NewKonnectedTemperatureSensor(v.Name)
+			acc.pins[v.Pin] = p
+			alarm.AddS(p.S)
+			log.Info.Printf("Konnected Pin: %d: %s (temperature, every %d minutes)", v.Pin, v.Name, v.Poll)
+		case "temp_humidity":
+			p := NewKonnectedTempHumidity(v.Name)
+			acc.pins[v.Pin] = p
+			alarm.AddS(p.Temperature.S)
+			alarm.AddS(p.Humidity.S)
+			log.Info.Printf("Konnected Pin: %d: %s (temperature & humidity, every %d minutes)", v.Pin, v.Name, v.Poll)
 		case "unused": // not used
 		default:
 			log.Info.Printf("unknown KonnectedZone type: %+v", v)
@@ -121,6 +106,10 @@ func NewKonnected(details *system, d *Device, stateManager *PersistentState) *Ko
 				p.ContactSensorState.SetValue(int(v.State))
 			case *KonnectedMotionSensor:
 				p.MotionDetected.SetValue(false)
+			case *KonnectedSafetySensor:
+				p.Detected.SetValue(int(v.State))
+			case *KonnectedGlassBreakSensor:
+				p.ContactSensorState.SetValue(int(v.State))
 			case *KonnectedBuzzer:
 				// p.Switch.On.SetValue(false)
 			default:
@@ -132,31 +121,13 @@ func NewKonnected(details *system, d *Device, stateManager *PersistentState) *Ko
 	return &acc
 }
 
-type KonnectedSvc struct {
-	*service.S
-
-	SecuritySystemCurrentState *characteristic.SecuritySystemCurrentState
-	SecuritySystemTargetState  *characteristic.SecuritySystemTargetState
-}
-
-func NewKonnectedSvc() *KonnectedSvc {
-	s := KonnectedSvc{}
-	s.S = service.New(service.TypeSecuritySystem)
-
-	s.SecuritySystemCurrentState = characteristic.NewSecuritySystemCurrentState()
-	s.AddC(s.SecuritySystemCurrentState.C)
-
-	s.SecuritySystemTargetState = characteristic.NewSecuritySystemTargetState()
-	s.AddC(s.SecuritySystemTargetState.C)
-
-	return &s
-}
-
 type KonnectedContactSensor struct {
 	*service.S
 
 	ContactSensorState *characteristic.ContactSensorState
 	Name               *characteristic.Name
+	rules              map[string]string
+	id                 string
 }
 
 func NewKonnectedContactSensor(name string) *KonnectedContactSensor {
@@ -178,6 +149,8 @@ type KonnectedMotionSensor struct {
 
 	MotionDetected *characteristic.MotionDetected
 	Name           *characteristic.Name
+	rules          map[string]string
+	id             string
 }
 
 func NewKonnectedMotionSensor(name string) *KonnectedMotionSensor {
@@ -194,6 +167,108 @@ func NewKonnectedMotionSensor(name string) *KonnectedMotionSensor {
 	return &s
 }
 
+// KonnectedSafetySensor is a smoke, carbon monoxide or leak detector relay.
+// Smoke and co sound the siren in every state. A leak only chirps the buzzer, it never sounds the siren
+// and takes no rules, HomeKit automations on LeakDetected are the place to do more.
+type KonnectedSafetySensor struct {
+	*service.S
+
+	Detected *characteristic.Int // SmokeDetected, CarbonMonoxideDetected or LeakDetected, all 0 normal, 1 detected
+	Name     *characteristic.Name
+	kind     string
+}
+
+func NewKonnectedSafetySensor(kind, name string) *KonnectedSafetySensor {
+	s := KonnectedSafetySensor{kind: kind}
+
+	switch kind {
+	case "smoke":
+		s.S = service.New(service.TypeSmokeSensor)
+		s.Detected = characteristic.NewSmokeDetected().Int
+	case "co":
+		s.S = service.New(service.TypeCarbonMonoxideSensor)
+		s.Detected = characteristic.NewCarbonMonoxideDetected().Int
+	default:
+		s.S = service.New(service.TypeLeakSensor)
+		s.Detected = characteristic.NewLeakDetected().Int
+	}
+	s.AddC(s.Detected.C)
+
+	s.Name = characteristic.NewName()
+	s.Name.SetValue(name)
+	s.AddC(s.Name.C)
+
+	return &s
+}
+
+// lifeSafety zones sound the siren no matter what the system is set to
+func (s *KonnectedSafetySensor) lifeSafety() bool {
+	return s.kind == "smoke" || s.kind == "co"
+}
+
+// KonnectedGlassBreakSensor shows as a contact sensor, open when glass breaks
+type KonnectedGlassBreakSensor struct {
+	*KonnectedContactSensor
+}
+
+// KonnectedTemperatureSensor is a DS18B20 probe
+type KonnectedTemperatureSensor struct {
+	*service.S
+
+	CurrentTemperature *characteristic.CurrentTemperature
+	Name               *characteristic.Name
+}
+
+func NewKonnectedTemperatureSensor(name string) *KonnectedTemperatureSensor {
+	s := KonnectedTemperatureSensor{}
+	s.S = service.New(service.TypeTemperatureSensor)
+
+	s.CurrentTemperature = characteristic.NewCurrentTemperature()
+	s.CurrentTemperature.SetMinValue(-55) // the DS18B20 range, HomeKit defaults to 0-100
+	s.CurrentTemperature.SetMaxValue(125)
+	s.AddC(s.CurrentTemperature.C)
+
+	s.Name = characteristic.NewName()
+	s.Name.SetValue(name)
+	s.AddC(s.Name.C)
+
+	return &s
+}
+
+type KonnectedHumiditySensor struct {
+	*service.S
+
+	CurrentRelativeHumidity *characteristic.CurrentRelativeHumidity
+	Name                    *characteristic.Name
+}
+
+func NewKonnectedHumiditySensor(name string) *KonnectedHumiditySensor {
+	s := KonnectedHumiditySensor{}
+	s.S = service.New(service.TypeHumiditySensor)
+
+	s.CurrentRelativeHumidity = characteristic.NewCurrentRelativeHumidity()
+	s.AddC(s.CurrentRelativeHumidity.C)
+
+	s.Name = characteristic.NewName()
+	s.Name.SetValue(name)
+	s.AddC(s.Name.C)
+
+	return &s
+}
+
+// KonnectedTempHumidity is a DHT sensor, one pin with two services
+type KonnectedTempHumidity struct {
+	Temperature *KonnectedTemperatureSensor
+	Humidity    *KonnectedHumiditySensor
+}
+
+func NewKonnectedTempHumidity(name string) *KonnectedTempHumidity {
+	return &KonnectedTempHumidity{
+		Temperature: NewKonnectedTemperatureSensor(name),
+		Humidity:    NewKonnectedHumiditySensor(name),
+	}
+}
+
 type KonnectedBuzzer struct {
 	*accessory.A
 	Switch *KonnectedBuzzerSvc
@@ -214,15 +289,15 @@ func NewKonnectedBuzzer(name string) *KonnectedBuzzer {
 	return &a
 }
 
-type KonnectedBuzzerSvc struct {
+type KonnectedBypassSvc struct {
 	*service.S
 
 	On   *characteristic.On
 	Name *characteristic.Name
 }
 
-func NewKonnectedBuzzerSvc(name string) *KonnectedBuzzerSvc {
-	s := KonnectedBuzzerSvc{}
+func NewKonnectedBypassSvc(name string) *KonnectedBypassSvc {
+	s := KonnectedBypassSvc{}
 	s.S = service.New(service.TypeSwitch)
 
 	s.On = characteristic.NewOn()
@@ -235,95 +310,110 @@ func NewKonnectedBuzzerSvc(name string) *KonnectedBuzzerSvc {
 	return &s
 }
 
-func (k *Konnected) triggerCountdown() {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-
-	// If already counting down or triggered, don't start another goroutine
-	if k.alarmCancel != nil {
-		return
-	}
+type KonnectedBuzzerSvc struct {
+	*service.S
 
-	ctx, cancel := context.WithCancel(context.Background())
-	k.alarmCancel = cancel
+	On   *characteristic.On
+	Name *characteristic.Name
+}
 
-	go func() {
-		log.Info.Println("Alarm countdown started...")
-		k.doBuzz(`"state":1, "momentary":50, "pause":450`)
+func NewKonnectedBuzzerSvc(name string) *KonnectedBuzzerSvc {
+	s := KonnectedBuzzerSvc{}
+	s.S = service.New(service.TypeSwitch)
 
-		select {
-		case <-time.After(1 * time.Minute):
-			k.instantAlarm()
-		case <-ctx.Done():
-			log.Info.Println("Countdown cancelled by user disarm.")
-		}
-	}()
-}
+	s.On = characteristic.NewOn()
+	s.AddC(s.On.C)
 
-func (k *Konnected) stopAllAlarmLogic() {
-	k.mu.Lock()
-	defer k.mu.Unlock()
+	s.Name = characteristic.NewName()
+	s.Name.SetValue(name)
+	s.AddC(s.Name.C)
 
-	if k.alarmCancel != nil {
-		k.alarmCancel()
-		k.alarmCancel = nil
-	}
-	k.doBuzz(`"state": 0`)
+	return &s
 }
 
 func (s *KonnectedContactSensor) Handle(state uint8, k *Konnected) {
-    log.Info.Printf("Pin Update: %s (pin %d) is %d", s.Name.Value(), s.ContactSensorState.Value(), state)
+	log.Info.Printf("Pin Update: %s is %d", s.Name.Value(), state)
 	s.ContactSensorState.SetValue(int(state))
 
 	if state == 0 {
-		k.doorCloseChirps()
+		k.alarm.chirp(buzzDoorClose)
 		return
 	}
 
-	sysState := k.SecuritySystem.SecuritySystemCurrentState.Value()
-
-	switch sysState {
-	case characteristic.SecuritySystemCurrentStateAwayArm:
-		log.Info.Printf("Entry on pin while Away")
-		k.triggerCountdown()
+	k.alarm.trip(s.id, s.Name.Value(), s.rules, buzzDoorOpen)
+}
 
-	case characteristic.SecuritySystemCurrentStateNightArm:
-		log.Info.Printf("Entry on pin while Night")
-		k.instantAlarm()
+func (s *KonnectedMotionSensor) Handle(state uint8, k *Konnected) {
+	log.Info.Printf("Pin Update: %s is %d", s.Name.Value(), state)
+	s.MotionDetected.SetValue(state == 1)
 
-	case characteristic.SecuritySystemCurrentStateStayArm:
-		k.doorOpenChirps()
+	if state == 0 {
+		return
 	}
+
+	k.alarm.trip(s.id, s.Name.Value(), s.rules, buzzMotion)
 }
 
-func (s *KonnectedMotionSensor) Handle(state uint8, k *Konnected) {
-    log.Info.Printf("Pin Update: %s (pin %d) is %d", s.Name.Value(), s.MotionDetected.Value(), state)
-	s.MotionDetected.SetValue(state == 1)
+func (s *KonnectedSafetySensor) Handle(state uint8, k *Konnected) {
+	log.Info.Printf("Pin Update: %s (%s) is %d", s.Name.Value(), s.kind, state)
+	s.Detected.SetValue(int(state))
 
 	if state == 0 {
+		if s.lifeSafety() {
+			k.alarm.lifeSafetyClear(s.Name.Value())
+		}
 		return
 	}
 
-	sysState := k.SecuritySystem.SecuritySystemCurrentState.Value()
+	if s.lifeSafety() {
+		log.Info.Printf("%s detected: %s", s.kind, s.Name.Value())
+		k.alarm.lifeSafety(s.Name.Value())
+		return
+	}
 
-	switch sysState {
-	case characteristic.SecuritySystemCurrentStateAwayArm:
-		log.Info.Printf("Motion detected while Away")
-		k.triggerCountdown()
+	// leaks alert in every state, but don't wake the neighbors
+	k.alarm.chirp(buzzDoorOpen)
+}
 
-	case characteristic.SecuritySystemCurrentStateNightArm:
-		log.Info.Printf("Motion detected while Night")
-		k.motionChirps()
+func (s *KonnectedGlassBreakSensor) Handle(state uint8, k *Konnected) {
+	log.Info.Printf("Pin Update: %s (glass break) is %d", s.Name.Value(), state)
+	s.ContactSensorState.SetValue(int(state))
 
-	case characteristic.SecuritySystemCurrentStateStayArm:
-		// optional
+	if state == 0 {
+		return
 	}
+
+	k.alarm.trip(s.id, s.Name.Value(), s.rules, buzzDoorOpen)
 }
 
 func (b *KonnectedBuzzer) Handle(state uint8, k *Konnected) {
 	log.Info.Printf("%s: %d", b.Switch.Name.Value(), state)
 }
 
+// Handle is never called for a temperature sensor, the board sends readings
+func (s *KonnectedTemperatureSensor) Handle(state uint8, k *Konnected) {}
+
+func (s *KonnectedTemperatureSensor) HandleReading(p sensor, k *Konnected) {
+	if p.Temp == nil {
+		return
+	}
+	log.Debug.Printf("Pin Update: %s (pin %d) is %.1fC %s", s.Name.Value(), p.Pin, *p.Temp, p.Addr)
+	s.CurrentTemperature.SetValue(*p.Temp)
+}
+
+func (s *KonnectedTempHumidity) Handle(state uint8, k *Konnected) {}
+
+func (s *KonnectedTempHumidity) HandleReading(p sensor, k *Konnected) {
+	if p.Temp != nil {
+		log.Debug.Printf("Pin Update: %s (pin %d) is %.1fC", s.Temperature.Name.Value(), p.Pin, *p.Temp)
+		s.Temperature.CurrentTemperature.SetValue(*p.Temp)
+	}
+	if p.Humi != nil {
+		log.Debug.Printf("Pin Update: %s (pin %d) is %.1f%%", s.Humidity.Name.Value(), p.Pin, *p.Humi)
+		s.Humidity.CurrentRelativeHumidity.SetValue(*p.Humi)
+	}
+}
+
 /* type KonnectedTrigger struct {
 	*accessory.A
 
@@ -0,0 +1,236 @@
+package konnectedkhbridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/log"
+)
+
+// how many rotated files are kept, events.jsonl.1 is the newest
+const eventLogKeep = 5
+
+// Event is one line in the event log
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`           // disarmed, exit_delay, armed, countdown, triggered, silenced, zone, bypass
+	Zone   string    `json:"zone,omitempty"` // the zone that caused it
+	Detail string    `json:"detail,omitempty"`
+	Mode   string    `json:"mode"`   // arm mode: stay, away, night, disarm
+	State  string    `json:"state"`  // alarm state after the event
+	Source string    `json:"source"` // homekit, http, timeout, api
+}
+
+// EventLog is an append-only JSON lines file, rotated by size
+type EventLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func NewEventLog(path string, maxSize int64) (*EventLog, error) {
+	l := EventLog{
+		path:    path,
+		maxSize: maxSize,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (l *EventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+// Record appends an event, a nil log records nothing
+func (l *EventLog) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Info.Println(err.Error())
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Info.Printf("unable to rotate event log: %s", err.Error())
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		log.Info.Printf("unable to write event log: %s", err.Error())
+	}
+}
+
+// rotate shifts events.jsonl to events.jsonl.1, .1 to .2 and so on, dropping the oldest
+func (l *EventLog) rotate() error {
+	l.f.Close()
+	l.f = nil
+
+	for i := eventLogKeep - 1; i > 0; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *EventLog) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// EventQuery filters the events returned by Query, zero values match everything
+type EventQuery struct {
+	Since time.Time
+	Until time.Time
+	Zone  string
+	Type  string
+	Limit int // the most recent Limit events
+}
+
+func (q EventQuery) match(e Event) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Zone != "" && e.Zone != q.Zone {
+		return false
+	}
+	if q.Type != "" && e.Type != q.Type {
+		return false
+	}
+	return true
+}
+
+// Query reads the rotated files and the current one, oldest first. The files are opened under the lock and read
+// without it, so a long query doesn't hold up Record, and a rotation part way through doesn't move them.
+func (l *EventLog) Query(q EventQuery) ([]Event, error) {
+	events := []Event{}
+	if l == nil {
+		return events, nil
+	}
+
+	files, err := l.snapshot()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// a line cut short by a crash
+				continue
+			}
+			if q.match(e) {
+				events = append(events, e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
+
+// snapshotFile stops at the size the file had when it was opened, so lines recorded during the query are left out
+type snapshotFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (s snapshotFile) Close() error {
+	return s.f.Close()
+}
+
+// snapshot opens the files that exist right now, oldest first
+func (l *EventLog) snapshot() ([]io.ReadCloser, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var files []io.ReadCloser
+	names := []string{}
+	for i := eventLogKeep; i > 0; i-- {
+		names = append(names, l.rotated(i))
+	}
+	names = append(names, l.path)
+
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return files, err
+		}
+		if name == l.path {
+			files = append(files, snapshotFile{Reader: io.LimitReader(f, l.size), f: f})
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (l *EventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
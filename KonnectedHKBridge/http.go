@@ -2,11 +2,14 @@ package konnectedkhbridge
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/brutella/hap/log"
@@ -56,7 +59,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		k.ip = fmt.Sprintf("%s:%s", remHost, setPort)
 
 		// if the device wasn't discovered on boot, the port will be garbage, re-discover
-		if k.A.Info.FirmwareRevision.Value() == "bootstrap" {
+		if k.firmware == "bootstrap" {
 			ip := discover(device)
 			if ip != "" {
 				log.Info.Printf("rediscovery: (%s) got: (%s)", device, ip)
@@ -100,13 +103,26 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	respondOK(w)
 }
 
-func HTTPServer(ctx context.Context, addr string) {
+func HTTPServer(ctx context.Context, addr string, adminToken string, events *EventLog) {
 	router := chi.NewRouter()
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		// do something better here
 		w.Write([]byte("Konnected HomeKit Bridge"))
 	})
 
+	// the log shows when the house is empty
+	router.With(adminAuth(adminToken)).Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		eventsHandler(w, r, events)
+	})
+
+	// the zones show which doors and windows are open, so even listing them needs the token
+	router.Route("/zones", func(r chi.Router) {
+		r.Use(adminAuth(adminToken))
+		r.Get("/", zonesHandler)
+		r.Put("/{zone}/bypass", bypassHandler)
+		r.Delete("/{zone}/bypass", bypassHandler)
+	})
+
 	router.Route("/konnected/device/{device}", func(r chi.Router) {
 		r.Get("/", handler)
 		r.Put("/", handler)
@@ -121,7 +137,12 @@ func HTTPServer(ctx context.Context, addr string) {
 	}
 
 	log.Info.Printf("starting http service at %s", addr)
-	go srv.ListenAndServe()
+	go func() {
+		// without the HTTP service the panels can't report, so a port already in use has to show up in the log
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Info.Printf("http service at %s failed: %s", addr, err)
+		}
+	}()
 	<-ctx.Done()
 	log.Info.Printf("stopping http service")
 	if err := srv.Shutdown(context.Background()); err != nil {
@@ -129,6 +150,96 @@ func HTTPServer(ctx context.Context, addr string) {
 	}
 }
 
+// eventsHandler returns the event log, filtered by ?since=&until= (RFC 3339), ?zone=, ?type= and ?limit=
+func eventsHandler(w http.ResponseWriter, r *http.Request, events *EventLog) {
+	var q EventQuery
+	var err error
+
+	v := r.URL.Query()
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	q.Zone = v.Get("zone")
+	q.Type = v.Get("type")
+
+	list, err := events.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Info.Println(err.Error())
+	}
+}
+
+// adminAuth lets requests through with the admin token, or none at all if no token is configured
+func adminAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, "AdminToken not configured", http.StatusForbidden)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "Authorization token invalid", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// zonesHandler lists the zones that can be bypassed
+func zonesHandler(w http.ResponseWriter, r *http.Request) {
+	a := panel.Load()
+	if a == nil {
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.Zones()); err != nil {
+		log.Info.Println(err.Error())
+	}
+}
+
+// bypassHandler bypasses a zone with PUT, ?persistent=true to keep it past the next disarm, and clears it with DELETE
+func bypassHandler(w http.ResponseWriter, r *http.Request) {
+	a := panel.Load()
+	if a == nil {
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+		return
+	}
+
+	persistent, _ := strconv.ParseBool(r.URL.Query().Get("persistent"))
+	if err := a.setBypass(chi.URLParam(r, "zone"), r.Method == http.MethodPut, persistent, "api"); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnknownZone) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	respondOK(w)
+}
+
 // for when we support multiple devices
 func chooseKonnected(mac string) *Konnected {
 	if k, ok := ks[mac]; ok {
@@ -0,0 +1,38 @@
+package konnectedkhbridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestBypassHandler(t *testing.T) {
+	a, _ := newTestAlarm(t, nil)
+	panel.Store(a)
+	t.Cleanup(func() { panel.Store(nil) })
+
+	router := chi.NewRouter()
+	router.Put("/zones/{zone}/bypass", bypassHandler)
+
+	put := func(zone string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/zones/"+zone+"/bypass", nil))
+		return rec.Code
+	}
+
+	if got := put("front"); got != http.StatusOK {
+		t.Errorf("known zone: %d, want 200", got)
+	}
+	if got := put("nosuch"); got != http.StatusNotFound {
+		t.Errorf("unknown zone: %d, want 404", got)
+	}
+
+	// state.json can't be written
+	a.persist.filepath = filepath.Join(t.TempDir(), "missing", "state.json")
+	if got := put("front"); got != http.StatusInternalServerError {
+		t.Errorf("save failed: %d, want 500", got)
+	}
+}
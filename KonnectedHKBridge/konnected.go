@@ -7,23 +7,35 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/brutella/hap/accessory"
-	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/log"
 )
 
+// AllowProvision lets the bridge write the configured settings to the boards, otherwise the changes are only logged.
+// A board with no endpoint set is always given the minimal endpoint, with or without it.
+var AllowProvision bool
+
 var client *http.Client
-var disarmed chan (bool)
 var ks map[string]*Konnected
 
+// panel is the security system shared by the boards, for the admin API. Startup sets it while HTTP is already serving.
+var panel atomic.Pointer[Alarm]
+
 // {"mac":"f4:cf:a2:6a:c2:6e","gw":"192.168.12.1","hwVersion":"3.0.0","settings":[],"rssi":-70,"nm":"255.255.255.0","ip":"192.168.12.252","actuators":[],"port":14996,"uptime":1248,"heap":34056,"swVersion":"3.0.1","dht_sensors":[],"ds18b20_sensors": [],"sensors":[]}
 
 type PinHandler interface {
 	Handle(state uint8, k *Konnected)
 }
 
+// readingHandler is a pin that reports measurements rather than open/closed
+type readingHandler interface {
+	HandleReading(p sensor, k *Konnected)
+}
+
 type system struct {
 	Settings  settings   `json:"settings"`
 	Mac       string     `json:"mac"`
@@ -33,7 +45,7 @@ type system struct {
 	Hardware  string     `json:"hwVersion,omitempty"`
 	Software  string     `json:"swVersion,omitempty"`
 	Sensors   []sensor   `json:"sensors"`
-	DBSensors []sensor   `json:"ds18b20_sensors"`
+	DBSensors []dht      `json:"ds18b20_sensors"`
 	Actuators []actuator `json:"actuators"`
 	DHTs      []dht      `json:"dht_sensors"`
 	Uptime    uint64     `json:"uptime,omitempty"`
@@ -53,7 +65,9 @@ type provisiondata struct {
 	Endpoint     string         `json:"endpoint,omitempty"`
 	Token        string         `json:"token,omitempty"`
 	Sensors      []provisionpin `json:"sensors"`
-	Actuators    []provisionpin `json:"actuators"`
+	Actuators    []actuator     `json:"actuators"`
+	DHTs         []dht          `json:"dht_sensors,omitempty"`
+	DBSensors    []dht          `json:"ds18b20_sensors,omitempty"`
 }
 
 type provisionpin struct {
@@ -62,9 +76,12 @@ type provisionpin struct {
 }
 
 type sensor struct {
-	Pin   uint8 `json:"pin"`
-	State uint8 `json:"state"`
-	Retry uint8 `json:"retry,omitempty"`
+	Pin   uint8    `json:"pin"`
+	State uint8    `json:"state"`
+	Retry uint8    `json:"retry,omitempty"`
+	Temp  *float64 `json:"temp,omitempty"` // DHT and DS18B20, celsius
+	Humi  *float64 `json:"humi,omitempty"` // DHT only
+	Addr  string   `json:"addr,omitempty"` // DS18B20 bus address
 }
 
 type actuator struct {
@@ -87,9 +104,7 @@ type command struct {
 
 // Startup sets the globals, discovers & loads settings from the from the Konnected devices
 // how to rediscover when IP addresses change, without needing to disrupt the HAP service?
-func Startup(ctx context.Context, config *Config, stateManager *PersistentState) ([]*accessory.A, error) {
-	disarmed = make(chan bool)
-
+func Startup(ctx context.Context, config *Config, stateManager *PersistentState, events *EventLog) ([]*accessory.A, error) {
 	client = &http.Client{
 		Transport: &http.Transport{MaxIdleConns: 5, IdleConnTimeout: 30 * time.Second},
 		Timeout:   time.Second * time.Duration(10),
@@ -98,8 +113,11 @@ func Startup(ctx context.Context, config *Config, stateManager *PersistentState)
 	// our list of devices, indexed by Mac
 	ks = make(map[string]*Konnected)
 
-	// the list returned to the caller, used to populate HAP
-	var klist []*accessory.A
+	// one security system for all the boards
+	alarm := NewAlarm(ctx, config, stateManager, events)
+
+	// the list returned to the caller, used to populate HAP, the alarm is the bridge
+	klist := []*accessory.A{alarm.A}
 
 	for _, d := range config.Devices {
 		if d.Mac == "" {
@@ -135,11 +153,11 @@ func Startup(ctx context.Context, config *Config, stateManager *PersistentState)
 			log.Info.Printf("unable to discover (%s); using bootstrap mode", d.Mac)
 		}
 
-		k := NewKonnected(details, &d, stateManager)
+		k := NewKonnected(details, &d, alarm)
 		// before or after NewKonnected?
 		k.provision(details, config, &d)
 		ks[d.Mac] = k
-		klist = append(klist, k.A)
+		alarm.addBoard(k, details)
 		if k.Buzzer != nil {
 			klist = append(klist, k.Buzzer.A)
 		}
@@ -148,6 +166,9 @@ func Startup(ctx context.Context, config *Config, stateManager *PersistentState)
 		} */
 	}
 
+	alarm.addBypassSwitches()
+	panel.Store(alarm)
+
 	return klist, nil
 }
 
@@ -228,89 +249,6 @@ func (k *Konnected) getStatusAndUpdate() error {
 	return nil
 }
 
-func (k *Konnected) beep() {
-	if k.SecuritySystem.SecuritySystemCurrentState.Value() !=
-		characteristic.SecuritySystemCurrentStateAlarmTriggered {
-		k.doBuzz(`"state":1, "momentary":120, "times":2, "pause":55`)
-	} else {
-		log.Info.Println("not beeping since in triggered state")
-	}
-}
-
-func (k *Konnected) doorOpenChirps() {
-	if k.SecuritySystem.SecuritySystemCurrentState.Value() !=
-		characteristic.SecuritySystemCurrentStateAlarmTriggered {
-		k.doBuzz(`"state":1, "momentary":10, "times":5, "pause":30`)
-	} else {
-		log.Info.Println("not doing door chirps since in triggered state")
-	}
-}
-
-func (k *Konnected) doorCloseChirps() {
-	if k.SecuritySystem.SecuritySystemCurrentState.Value() !=
-		characteristic.SecuritySystemCurrentStateAlarmTriggered {
-		k.doBuzz(`"state":1, "momentary":15, "times":2, "pause":45`)
-	} else {
-		log.Info.Println("not doing door chirps since in triggered state")
-	}
-}
-
-func (k *Konnected) motionChirps() {
-	if k.SecuritySystem.SecuritySystemCurrentState.Value() !=
-		characteristic.SecuritySystemCurrentStateAlarmTriggered {
-		k.doBuzz(`"state":1, "momentary":5, "times":3, "pause":50`)
-	} else {
-		log.Info.Println("not doing motion chirps since in triggered state")
-	}
-}
-
-func (k *Konnected) instantAlarm() {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-
-	// Update HomeKit State
-	k.SecuritySystem.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
-
-	log.Info.Println("alarm triggered")
-	k.doBuzz(`"state":1`)
-
-	// If there's an existing countdown context, cancel it
-	if k.alarmCancel != nil {
-		k.alarmCancel()
-	}
-
-	// Create a new context for the "Siren Timeout"
-	ctx, cancel := context.WithCancel(context.Background())
-	k.alarmCancel = cancel
-
-	go func() {
-		select {
-		case <-time.After(5 * time.Minute):
-			log.Info.Println("Siren timeout reached (5 mins). Silencing.")
-			k.doBuzz(`"state":0`)
-		case <-ctx.Done():
-			// stopAllAlarmLogic was called (User disarmed)
-			k.doBuzz(`"state":0`)
-		}
-	}()
-}
-
-func (k *Konnected) countdownAlarm() {
-	log.Info.Println("starting countdown")
-	k.SecuritySystem.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
-
-	k.doBuzz(`"state":1, "momentary":50, "pause":450`)
-
-	go func() {
-		select {
-		case <-disarmed:
-			// cancelAlarm called
-		case <-time.After(1 * time.Minute):
-			k.instantAlarm()
-		}
-	}()
-}
-
 func (k *Konnected) getBuzzerPin() (uint8, *KonnectedBuzzer) {
 	for pid, pin := range k.pins {
 		switch pin := pin.(type) {
@@ -322,18 +260,6 @@ func (k *Konnected) getBuzzerPin() (uint8, *KonnectedBuzzer) {
 	return 0, nil
 }
 
-func (k *Konnected) cancelAlarm() {
-	if k.SecuritySystem.SecuritySystemCurrentState.Value() ==
-		characteristic.SecuritySystemCurrentStateDisarmed {
-		log.Info.Println("not triggered, nothing to cancel")
-		return
-	}
-
-	k.doBuzz(`"state": 0`)
-	disarmed <- true
-	k.SecuritySystem.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
-}
-
 func (k *Konnected) doBuzz(cmd string) error {
 	pin, _ := k.getBuzzerPin()
 
@@ -382,58 +308,146 @@ func provisionMinimal(c *Config, d *Device) error {
 
 }
 
-// too dangerous to use just yet
+// provision compares the board's settings with the config and, if they differ and AllowProvision is set, writes the config to the board
 func (k *Konnected) provision(s *system, c *Config, d *Device) error {
 	// curl -X PUT -H "Content-Type: application/json" -d '{"endpoint_type":"rest", "endpoint":"http://192.168.12.253:8444/konnected", "token":"notyet", "sensors":[{"pin":1},{"pin":2},{"pin":5},{"pin":6},{"pin":7},{"pin":9}]}' http://192.168.12.186:15301/settings
 
-	if d.Mac == "bootstrap" || d.ip == "" {
+	if d.Mac == "bootstrap" || d.ip == "" || s.Hardware == "bootstrap" {
 		log.Info.Printf("not reprovisioning device in bootstrap mode")
 		return nil
 	}
 
-	newEndpoint := fmt.Sprintf("http://%s/konnected", c.ListenAddr)
-	if s.Settings.Endpoint == newEndpoint {
+	rpd := provisionData(c, d)
+	diffs := s.diff(rpd)
+	if len(diffs) == 0 {
+		log.Info.Printf("%s: board settings match the config", d.Mac)
+		return nil
+	}
+	for _, diff := range diffs {
+		log.Info.Printf("%s: %s", d.Mac, diff)
+	}
+
+	b, err := json.Marshal(rpd)
+	if err != nil {
+		log.Info.Println(err.Error())
+		return err
+	}
+
+	if !AllowProvision {
+		log.Info.Printf("%s: dry run, restart with --provision to send: %s", d.Mac, b)
 		return nil
 	}
 
-	log.Info.Printf("endpoints differ, reprovisioning: %s / %s", s.Settings.Endpoint, newEndpoint)
+	log.Info.Printf("reprovisioning: %s", b)
+	url := fmt.Sprintf("http://%s/settings", d.ip)
+	result, err := doRequest("PUT", url, bytes.NewReader(b))
+	if err != nil {
+		log.Info.Println(err.Error())
+		return err
+	}
+	log.Info.Printf("%s", *result)
+	return nil
+}
 
+// provisionData is the board settings the config calls for
+func provisionData(c *Config, d *Device) *provisiondata {
 	rpd := provisiondata{
 		EndpointType: "rest",
-		Endpoint:     newEndpoint,
+		Endpoint:     fmt.Sprintf("http://%s/konnected", c.ListenAddr),
 		Token:        d.Password,
+		Sensors:      []provisionpin{},
+		Actuators:    []actuator{},
 	}
 	for _, p := range d.Zones {
 		switch p.Type {
-		case "door", "motion":
+		case "door", "motion", "smoke", "co", "leak", "glassbreak":
 			rpd.Sensors = append(rpd.Sensors, provisionpin{Pin: p.Pin})
-		// case "buzzer":
-		//	rpd.Actuators = append(rpd.Actuators, provisionpin{Pin: p.Pin})
-		case "buzzer", "unused":
+		case "temperature":
+			rpd.DBSensors = append(rpd.DBSensors, dht{Pin: p.Pin, Poll: p.Poll})
+		case "temp_humidity":
+			rpd.DHTs = append(rpd.DHTs, dht{Pin: p.Pin, Poll: p.Poll})
+		case "buzzer":
+			rpd.Actuators = append(rpd.Actuators, actuator{Pin: p.Pin, Trigger: *p.Trigger})
+		case "unused":
 		default:
 			log.Info.Printf("unknown type %+v", p)
 		}
 	}
-	// rpd.Actuators = append(rpd.Actuators, provisionpin{Trigger: 1})
+	return &rpd
+}
 
-	b, err := json.Marshal(rpd)
-	if err != nil {
-		log.Info.Println(err.Error())
-		return err
+// diff lists the differences between the board's settings and the provisioning data
+func (s *system) diff(p *provisiondata) []string {
+	var diffs []string
+
+	if s.Settings.EndpointType != p.EndpointType {
+		diffs = append(diffs, fmt.Sprintf("endpoint_type: %q -> %q", s.Settings.EndpointType, p.EndpointType))
 	}
-	log.Info.Printf("reprovisioning: %s", b)
-	// url := fmt.Sprintf("http://%s/settings", d.ip)
-	/* result, err := doRequest("PUT", url, bytes.NewReader(b))
-	if err != nil {
-		log.Info.Printf(err.Error())
-		return err
+	if s.Settings.Endpoint != p.Endpoint {
+		diffs = append(diffs, fmt.Sprintf("endpoint: %q -> %q", s.Settings.Endpoint, p.Endpoint))
 	}
-	log.Info.Printf("%s", result) */
-	return nil
+	// the board does not always report the token
+	if s.Settings.Token != "" && s.Settings.Token != p.Token {
+		diffs = append(diffs, "token differs")
+	}
+
+	var have, want []string
+	for _, v := range s.Sensors {
+		have = append(have, fmt.Sprint(v.Pin))
+	}
+	for _, v := range p.Sensors {
+		want = append(want, fmt.Sprint(v.Pin))
+	}
+	diffs = appendPinDiff(diffs, "sensors", have, want)
+
+	have, want = nil, nil
+	for _, v := range s.Actuators {
+		have = append(have, fmt.Sprintf("%d(trigger %d)", v.Pin, v.Trigger))
+	}
+	for _, v := range p.Actuators {
+		want = append(want, fmt.Sprintf("%d(trigger %d)", v.Pin, v.Trigger))
+	}
+	diffs = appendPinDiff(diffs, "actuators", have, want)
+
+	have, want = nil, nil
+	for _, v := range s.DHTs {
+		have = append(have, fmt.Sprintf("%d(every %dm)", v.Pin, v.Poll))
+	}
+	for _, v := range p.DHTs {
+		want = append(want, fmt.Sprintf("%d(every %dm)", v.Pin, v.Poll))
+	}
+	diffs = appendPinDiff(diffs, "dht_sensors", have, want)
+
+	have, want = nil, nil
+	for _, v := range s.DBSensors {
+		have = append(have, fmt.Sprintf("%d(every %dm)", v.Pin, v.Poll))
+	}
+	for _, v := range p.DBSensors {
+		want = append(want, fmt.Sprintf("%d(every %dm)", v.Pin, v.Poll))
+	}
+	diffs = appendPinDiff(diffs, "ds18b20_sensors", have, want)
+
+	return diffs
+}
+
+func appendPinDiff(diffs []string, name string, have, want []string) []string {
+	slices.Sort(have)
+	slices.Sort(want)
+	if slices.Equal(have, want) {
+		return diffs
+	}
+	return append(diffs, fmt.Sprintf("%s: %v -> %v", name, have, want))
 }
 
 func (k *Konnected) HandleUpdate(p sensor) {
 	if handler, ok := k.pins[p.Pin]; ok {
+		if rh, ok := handler.(readingHandler); ok {
+			rh.HandleReading(p, k)
+			return
+		}
+		if z, ok := k.zones[p.Pin]; ok && z.Type != "buzzer" {
+			k.alarm.zoneEvent(z.Name, p.State)
+		}
 		handler.Handle(p.State, k)
 		return
 	}
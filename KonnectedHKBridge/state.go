@@ -9,7 +9,14 @@ import (
 type PersistentState struct {
 	mu           sync.Mutex
 	filepath     string
-	SecurityMode int `json:"security_mode"`
+	SecurityMode int                `json:"security_mode"`
+	Bypass       map[string]*Bypass `json:"bypass,omitempty"` // by zone id
+}
+
+// Bypass keeps a zone from tripping the alarm
+type Bypass struct {
+	Persistent bool `json:"persistent"`      // until cleared, otherwise for one arming cycle
+	Armed      bool `json:"armed,omitempty"` // the system has armed since a one cycle bypass was set, the next disarm clears it
 }
 
 func NewPersistentState(path string) *PersistentState {
@@ -24,7 +31,77 @@ func (p *PersistentState) UpdateAndSave(mode int) error {
 	defer p.mu.Unlock()
 
 	p.SecurityMode = mode
+	return p.save()
+}
+
+// SetBypass bypasses a zone, or clears the bypass if b is nil
+func (p *PersistentState) SetBypass(id string, b *Bypass) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if b == nil {
+		delete(p.Bypass, id)
+		return p.save()
+	}
+	if p.Bypass == nil {
+		p.Bypass = make(map[string]*Bypass)
+	}
+	bb := *b
+	p.Bypass[id] = &bb
+	return p.save()
+}
+
+// Bypassed is the zone's bypass, nil if it isn't bypassed
+func (p *PersistentState) Bypassed(id string) *Bypass {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.Bypass[id]
+	if !ok {
+		return nil
+	}
+	bb := *b
+	return &bb
+}
+
+// ArmBypasses starts the arming cycle for the one cycle bypasses
+func (p *PersistentState) ArmBypasses() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed := false
+	for _, b := range p.Bypass {
+		if !b.Persistent && !b.Armed {
+			b.Armed = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return p.save()
+}
+
+// ClearCycleBypasses ends the arming cycle, returning the zones that are no longer bypassed
+func (p *PersistentState) ClearCycleBypasses() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var cleared []string
+	for id, b := range p.Bypass {
+		if !b.Persistent && b.Armed {
+			delete(p.Bypass, id)
+			cleared = append(cleared, id)
+		}
+	}
+	if len(cleared) == 0 {
+		return nil, nil
+	}
+	return cleared, p.save()
+}
 
+// save writes the state, mu must be held
+func (p *PersistentState) save() error {
 	data, err := json.MarshalIndent(p, "", "  ")
 	if err != nil {
 		return err
@@ -3,7 +3,10 @@ package konnectedkhbridge
 import (
 	"fmt"
 	"net"
+	"net/url"
+	"slices"
 	"strings"
+	"text/template"
 )
 
 // Validate checks the top-level configuration
@@ -12,6 +15,10 @@ func (c *Config) Validate() error {
 		c.Pin = "80899303" // Default HomeKit Pin
 	}
 
+	if c.EventLog <= 0 {
+		c.EventLog = 1 << 20
+	}
+
 	// Ensure ListenAddr is valid if provided, or can be resolved
 	if c.ListenAddr != "" {
 		host, port, err := net.SplitHostPort(c.ListenAddr)
@@ -27,6 +34,27 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for name, m := range c.Modes {
+		// disarm only sets the siren for the life-safety zones
+		if name != "disarm" && !validMode(name) {
+			return fmt.Errorf("unknown arm mode '%s', must be stay, away, night or disarm", name)
+		}
+		if m == nil {
+			d := defaultArmMode()
+			c.Modes[name] = &d
+			continue
+		}
+		if m.SirenDuration == 0 {
+			return fmt.Errorf("arm mode %s: siren_duration must be at least 1 second", name)
+		}
+	}
+
+	for i, w := range c.Webhooks {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("webhook %d: %w", i, err)
+		}
+	}
+
 	if len(c.Devices) == 0 {
 		return fmt.Errorf("no devices configured")
 	}
@@ -66,7 +94,8 @@ func (d *Device) Validate() error {
 	}
 
 	pins := make(map[uint8]bool)
-	for _, z := range d.Zones {
+	for i := range d.Zones {
+		z := &d.Zones[i]
 		if z.Pin == 0 {
 			// Some Konnected boards use Pin 0, but usually it's a mistake in config
 			// We'll allow it but keep an eye on it.
@@ -76,9 +105,45 @@ func (d *Device) Validate() error {
 		}
 		pins[z.Pin] = true
 
+		if len(z.Rules) > 0 && defaultRules[z.Type] == nil {
+			return fmt.Errorf("rules are not supported for %s zones (pin %d)", z.Type, z.Pin)
+		}
+		switch z.BypassSwitch {
+		case "":
+			z.BypassSwitch = "none"
+		case "cycle", "persistent", "none":
+		default:
+			return fmt.Errorf("invalid bypass_switch '%s' for pin %d, must be cycle, persistent or none", z.BypassSwitch, z.Pin)
+		}
+		if z.BypassSwitch != "none" && defaultRules[z.Type] == nil {
+			return fmt.Errorf("%s zones can not be bypassed (pin %d)", z.Type, z.Pin)
+		}
+		for mode, rule := range z.Rules {
+			if !validMode(mode) {
+				return fmt.Errorf("unknown arm mode '%s' in rules for pin %d", mode, z.Pin)
+			}
+			switch rule {
+			case "ignore", "chirp", "delayed", "instant":
+			default:
+				return fmt.Errorf("invalid rule '%s' for %s on pin %d, must be ignore, chirp, delayed or instant", rule, mode, z.Pin)
+			}
+		}
+
 		switch z.Type {
-		case "motion", "door", "buzzer", "unused":
+		case "motion", "door", "smoke", "co", "leak", "glassbreak", "unused":
 			// valid
+		case "buzzer":
+			if z.Trigger == nil {
+				high := uint8(1)
+				z.Trigger = &high
+			}
+			if *z.Trigger > 1 {
+				return fmt.Errorf("invalid trigger %d for pin %d, must be 0 or 1", *z.Trigger, z.Pin)
+			}
+		case "temperature", "temp_humidity":
+			if z.Poll == 0 {
+				z.Poll = 3
+			}
 		default:
 			return fmt.Errorf("unsupported zone type '%s' for pin %d", z.Type, z.Pin)
 		}
@@ -86,3 +151,45 @@ func (d *Device) Validate() error {
 
 	return nil
 }
+
+// Validate checks a webhook and compiles its body template
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be http:// or https://: %s", w.URL)
+	}
+
+	if w.Method == "" {
+		w.Method = "POST"
+	}
+	w.Method = strings.ToUpper(w.Method)
+
+	if len(w.Events) == 0 {
+		w.Events = webhookEvents
+	}
+	for _, e := range w.Events {
+		if !slices.Contains(webhookEvents, e) {
+			return fmt.Errorf("unknown event '%s', must be one of %s", e, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	if w.Retries < 0 {
+		return fmt.Errorf("retries can not be negative")
+	}
+
+	if w.Body != "" {
+		t, err := template.New(w.URL).Parse(w.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body template: %w", err)
+		}
+		w.body = t
+	}
+	return nil
+}
+
+func validMode(mode string) bool {
+	return mode == "stay" || mode == "away" || mode == "night"
+}
@@ -0,0 +1,129 @@
+package konnectedkhbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"text/template"
+	"time"
+
+	"github.com/brutella/hap/log"
+)
+
+// the events a webhook can fire on
+var webhookEvents = []string{"triggered", "armed", "disarmed", "countdown"}
+
+// Webhook is an outgoing request made when the alarm changes state
+type Webhook struct {
+	Events  []string          `json:"events,omitempty"` // triggered, armed, disarmed, countdown (all of them)
+	Method  string            `json:"method,omitempty"` // (POST)
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`    // text/template with the Event fields, the event as JSON if empty
+	Retries int               `json:"retries,omitempty"` // attempts after the first one fails (3)
+
+	body *template.Template
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookAfter waits out the backoff, swapped out to retry without waiting
+var webhookAfter = time.After
+
+// UnmarshalJSON starts from the defaults, so "retries":0 turns retrying off
+func (w *Webhook) UnmarshalJSON(b []byte) error {
+	type plain Webhook
+	p := plain{Retries: 3}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*w = Webhook(p)
+	return nil
+}
+
+// webhookBackoff is how long to wait before retry n, doubling from a second up to a minute
+func webhookBackoff(n int) time.Duration {
+	d := time.Second << n
+	if d > time.Minute || d <= 0 {
+		return time.Minute
+	}
+	return d
+}
+
+func (w *Webhook) wants(typ string) bool {
+	return slices.Contains(w.Events, typ)
+}
+
+// fire sends the event, retrying with backoff until it gets a 2xx, a 4xx other than 429, or runs out of retries
+func (w *Webhook) fire(ctx context.Context, e Event) {
+	body, err := w.render(e)
+	if err != nil {
+		log.Info.Printf("webhook %s: %s", w.URL, err.Error())
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(ctx, body)
+		if err == nil {
+			log.Debug.Printf("webhook %s: sent %s", w.URL, e.Type)
+			return
+		}
+		if !retry || attempt >= w.Retries {
+			log.Info.Printf("webhook %s: giving up on %s: %s", w.URL, e.Type, err.Error())
+			return
+		}
+
+		wait := webhookBackoff(attempt)
+		log.Info.Printf("webhook %s: %s, retrying in %s", w.URL, err.Error(), wait)
+		select {
+		case <-webhookAfter(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Webhook) render(e Event) ([]byte, error) {
+	if w.body == nil {
+		return json.Marshal(e)
+	}
+
+	var buf bytes.Buffer
+	if err := w.body.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// send makes one attempt, retry is false when trying again won't help
+func (w *Webhook) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, w.Method, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if w.body == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %s", resp.Status)
+	}
+	return false, fmt.Errorf("status %s", resp.Status)
+}
@@ -0,0 +1,197 @@
+package konnectedkhbridge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// noWait records the backoffs instead of sleeping through them
+func noWait(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var waits []time.Duration
+	var mu sync.Mutex
+	old := webhookAfter
+	webhookAfter = func(d time.Duration) <-chan time.Time {
+		mu.Lock()
+		waits = append(waits, d)
+		mu.Unlock()
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	t.Cleanup(func() { webhookAfter = old })
+	return &waits
+}
+
+// newWebhook reads the config the way khkb.json would be read, so the defaults apply
+func newWebhook(t *testing.T, conf string) *Webhook {
+	t.Helper()
+	var w Webhook
+	if err := json.Unmarshal([]byte(conf), &w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &w
+}
+
+type received struct {
+	method      string
+	contentType string
+	auth        string
+	body        string
+}
+
+// hookServer answers with the statuses in order, then 200
+func hookServer(t *testing.T, statuses ...int) (*httptest.Server, func() []received) {
+	t.Helper()
+	var mu sync.Mutex
+	var got []received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, received{r.Method, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(body)})
+		status := http.StatusOK
+		if len(got) <= len(statuses) {
+			status = statuses[len(got)-1]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(got)
+	}
+}
+
+var testEvent = Event{
+	Time:   time.Date(2026, 10, 18, 22, 0, 0, 0, time.UTC),
+	Type:   "triggered",
+	Zone:   "Back Door",
+	Mode:   "away",
+	State:  "triggered",
+	Source: "timeout",
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  string
+		statuses []int
+		attempts int
+		waits    []time.Duration
+	}{
+		{"success", "", nil, 1, nil},
+		{"429 is retried", "", []int{429}, 2, []time.Duration{time.Second}},
+		{"5xx is retried with growing backoff", "", []int{500, 502, 503}, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{"gives up after retries", "", []int{500, 500, 500, 500, 500}, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{"retries 0 turns retrying off", `, "retries":0`, []int{503}, 1, nil},
+		{"4xx is not retried", "", []int{404}, 1, nil},
+		{"401 is not retried", "", []int{401}, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waits := noWait(t)
+			srv, got := hookServer(t, tt.statuses...)
+			w := newWebhook(t, `{"url":"`+srv.URL+`"`+tt.retries+`}`)
+
+			w.fire(context.Background(), testEvent)
+
+			if n := len(got()); n != tt.attempts {
+				t.Errorf("%d attempts, want %d", n, tt.attempts)
+			}
+			if !slices.Equal(*waits, tt.waits) {
+				t.Errorf("waited %v, want %v", *waits, tt.waits)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for n, d := range want {
+		if got := webhookBackoff(n); got != d {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", n, got, d)
+		}
+	}
+	// the shift overflowing still waits a minute
+	if got := webhookBackoff(100); got != time.Minute {
+		t.Errorf("webhookBackoff(100) = %s, want 1m", got)
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	t.Run("default is the event as JSON", func(t *testing.T) {
+		srv, got := hookServer(t)
+		w := newWebhook(t, `{"url":"`+srv.URL+`"}`)
+		w.fire(context.Background(), testEvent)
+
+		r := got()
+		if len(r) != 1 {
+			t.Fatalf("%d requests, want 1", len(r))
+		}
+		if r[0].method != http.MethodPost || r[0].contentType != "application/json" {
+			t.Errorf("%s %s, want POST application/json", r[0].method, r[0].contentType)
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(r[0].body), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e != testEvent {
+			t.Errorf("body %+v, want %+v", e, testEvent)
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		srv, got := hookServer(t)
+		w := newWebhook(t, `{"url":"`+srv.URL+`", "method":"put", "headers":{"Authorization":"Bearer abc"},
+			"body":"{\"text\":\"{{.Zone}} {{.Type}} while {{.Mode}}\"}"}`)
+		w.fire(context.Background(), testEvent)
+
+		r := got()
+		if len(r) != 1 {
+			t.Fatalf("%d requests, want 1", len(r))
+		}
+		if r[0].method != http.MethodPut || r[0].auth != "Bearer abc" || r[0].contentType != "" {
+			t.Errorf("got %s, Authorization %q, Content-Type %q", r[0].method, r[0].auth, r[0].contentType)
+		}
+		if want := `{"text":"Back Door triggered while away"}`; r[0].body != want {
+			t.Errorf("body %s, want %s", r[0].body, want)
+		}
+	})
+}
+
+func TestWebhookWants(t *testing.T) {
+	all := newWebhook(t, `{"url":"http://example.com/"}`)
+	some := newWebhook(t, `{"url":"http://example.com/", "events":["triggered", "disarmed"]}`)
+
+	for _, typ := range []string{"triggered", "armed", "disarmed", "countdown"} {
+		if !all.wants(typ) {
+			t.Errorf("default webhook doesn't want %s", typ)
+		}
+	}
+	for typ, want := range map[string]bool{"triggered": true, "disarmed": true, "armed": false, "countdown": false, "zone": false, "exit_delay": false} {
+		if got := some.wants(typ); got != want {
+			t.Errorf("wants(%s) = %v, want %v", typ, got, want)
+		}
+	}
+
+	var bad Webhook
+	if err := json.Unmarshal([]byte(`{"url":"http://example.com/", "events":["zone"]}`), &bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.Validate(); err == nil {
+		t.Error("zone accepted as a webhook event")
+	}
+}